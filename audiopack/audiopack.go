@@ -1,76 +1,53 @@
 package audiopack
 
 import (
+	"context"
 	"fmt"
+	"hello/cmdrun"
 	"hello/pitching"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+
+	"gitlab.com/gomidi/midi/v2"
+	"gitlab.com/gomidi/midi/v2/smf"
 )
 
 type NoteSegment struct {
 	Start float64
 	End   float64
 	Note  int
+	Pitch float64 // detected pitch in fractional MIDI notes, 0 if unknown
 }
 
 const MinClipDuration = 0.25 // seconds
 
+// Runner executes every external tool this package calls. Swap it for a
+// *cmdrun.Recorder to capture the exact commands without ffmpeg/aubio installed.
+var Runner cmdrun.Runner = cmdrun.Default
+
 func RunAubioNotes(audioPath string) ([]string, error) {
-	cmd := exec.Command("aubionotes", audioPath)
-	stdout, err := cmd.StdoutPipe()
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(), "aubionotes", audioPath)
 	if err != nil {
-		return nil, err
-	}
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Start(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("aubionotes %s: %w, output: %s", audioPath, err, strings.TrimSpace(string(res.Stderr)))
 	}
 
 	var lines []string
-	buf := make([]byte, 1024)
-	for {
-		n, err := stdout.Read(buf)
-		if n > 0 {
-			for _, line := range strings.Split(string(buf[:n]), "\n") {
-				line = strings.TrimSpace(line)
-				if line != "" {
-					lines = append(lines, line)
-				}
-			}
-		}
-		if err != nil {
-			break
+	for _, line := range strings.Split(string(res.Stdout), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
 		}
 	}
 
-	if err := cmd.Wait(); err != nil {
-		return nil, err
-	}
-
 	return lines, nil
 }
 
 func ParseAubioOutput(lines []string) []NoteSegment {
-	var segments []NoteSegment
-
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) == 3 {
-			start, err1 := strconv.ParseFloat(fields[1], 64)
-			end, err2 := strconv.ParseFloat(fields[2], 64)
-			noteFloat, err3 := strconv.ParseFloat(fields[0], 64)
-			note := int(noteFloat)
-
-			if err1 == nil && err2 == nil && err3 == nil && (end-start) >= MinClipDuration {
-				segments = append(segments, NoteSegment{Start: start, End: end, Note: note})
-			}
-		}
-	}
+	segments := parseAubioNotes(lines, MinClipDuration)
 	fmt.Println("Segments parsed:", len(segments))
 
 	return segments
@@ -113,7 +90,7 @@ func FilterAudioSegments(segments []NoteSegment, videoPath string, thresholdPerc
 
 // getMeanVolume returns the mean volume in dB for the entire audio
 func getMeanVolume(videoPath string) (float64, error) {
-	cmd := exec.Command(
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(),
 		"ffmpeg",
 		"-i", videoPath,
 		"-af", "volumedetect",
@@ -121,8 +98,7 @@ func getMeanVolume(videoPath string) (float64, error) {
 		"-f", "null",
 		"-",
 	)
-
-	output, err := cmd.CombinedOutput()
+	output := res.Combined()
 	if err != nil {
 		return 0, fmt.Errorf("ffmpeg volumedetect failed: %w", err)
 	}
@@ -150,7 +126,7 @@ func getMeanVolume(videoPath string) (float64, error) {
 // getSegmentVolume returns the mean volume in dB for a specific time segment
 func getSegmentVolume(videoPath string, start, end float64) (float64, error) {
 	duration := end - start
-	cmd := exec.Command(
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(),
 		"ffmpeg",
 		"-ss", fmt.Sprintf("%.3f", start),
 		"-t", fmt.Sprintf("%.3f", duration),
@@ -160,8 +136,7 @@ func getSegmentVolume(videoPath string, start, end float64) (float64, error) {
 		"-f", "null",
 		"-",
 	)
-
-	output, err := cmd.CombinedOutput()
+	output := res.Combined()
 	if err != nil {
 		return 0, fmt.Errorf("ffmpeg volumedetect failed: %w", err)
 	}
@@ -202,6 +177,8 @@ func PrepareAudio(segments []NoteSegment, audioPath string) []NoteSegment {
 		log.Fatalf("Error creating audio directory: %v", err)
 	}
 
+	segments = SnapSegments(segments)
+
 	for i, segment := range segments {
 		fmt.Printf("Processing segment %d/%d (Note %d, %.2f-%.2f sec)...\n",
 			i+1, len(segments), segment.Note, segment.Start, segment.End)
@@ -243,7 +220,7 @@ func PrepareAudio(segments []NoteSegment, audioPath string) []NoteSegment {
 func extractAudioSegment(inputAudio, outputAudio string, start, end float64) error {
 	duration := end - start
 
-	cmd := exec.Command(
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(),
 		"ffmpeg",
 		"-y",
 		"-ss", fmt.Sprintf("%.3f", start),
@@ -255,8 +232,7 @@ func extractAudioSegment(inputAudio, outputAudio string, start, end float64) err
 		"-ac", "2",
 		outputAudio,
 	)
-
-	output, err := cmd.CombinedOutput()
+	output := res.Combined()
 	if err != nil {
 		return fmt.Errorf("ffmpeg extract failed: %w, output: %s", err, string(output))
 	}
@@ -266,8 +242,8 @@ func extractAudioSegment(inputAudio, outputAudio string, start, end float64) err
 
 // copyFile copies a file from src to dst
 func copyFile(src, dst string) error {
-	cmd := exec.Command("cp", src, dst)
-	output, err := cmd.CombinedOutput()
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(), "cp", src, dst)
+	output := res.Combined()
 	if err != nil {
 		return fmt.Errorf("copy failed: %w, output: %s", err, string(output))
 	}
@@ -275,7 +251,7 @@ func copyFile(src, dst string) error {
 }
 
 func ExtractAudio(videoPath, audioPath string) error {
-	cmd := exec.Command(
+	_, err := Runner.Run(context.Background(),
 		"ffmpeg",
 		"-y",
 		"-i", videoPath,
@@ -285,13 +261,11 @@ func ExtractAudio(videoPath, audioPath string) error {
 		"-ac", "2",
 		audioPath,
 	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return err
 }
 
 func ReplaceAudioInVideo(videoPath, audioPath, outputPath string) error {
-	cmd := exec.Command(
+	_, err := Runner.Run(context.Background(),
 		"ffmpeg",
 		"-y",
 		"-i", videoPath,
@@ -302,11 +276,67 @@ func ReplaceAudioInVideo(videoPath, audioPath, outputPath string) error {
 		"-map", "1:a:0",
 		outputPath,
 	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return err
 }
 
 func ensureDir(dir string) error {
 	return os.MkdirAll(dir, os.ModePerm)
 }
+
+// ExportMIDI writes segments to a Standard MIDI File as one track of notes
+// on channel 1 at a fixed tempo, so a transcription can be checked and
+// edited in a DAW. Segment times are in seconds and are kept exactly in
+// wall-clock time; bpm only sets the grid the DAW shows.
+func ExportMIDI(segments []NoteSegment, path string, bpm float64) error {
+	if bpm <= 0 {
+		return fmt.Errorf("tempo must be positive, got %g BPM", bpm)
+	}
+	const resolution = 960
+	ticksPerSecond := resolution * bpm / 60
+
+	type timedMsg struct {
+		tick int64
+		off  bool
+		msg  midi.Message
+	}
+	var msgs []timedMsg
+	for _, seg := range segments {
+		if seg.Note < 0 || seg.Note > 127 || seg.End <= seg.Start {
+			continue
+		}
+		key := uint8(seg.Note)
+		msgs = append(msgs,
+			timedMsg{int64(seg.Start*ticksPerSecond + 0.5), false, midi.NoteOn(0, key, 100)},
+			timedMsg{int64(seg.End*ticksPerSecond + 0.5), true, midi.NoteOff(0, key)},
+		)
+	}
+	// Note-offs first at equal ticks so repeated notes retrigger
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if msgs[i].tick != msgs[j].tick {
+			return msgs[i].tick < msgs[j].tick
+		}
+		return msgs[i].off && !msgs[j].off
+	})
+
+	var tr smf.Track
+	tr.Add(0, smf.MetaTrackSequenceName("Transcription"))
+	tr.Add(0, smf.MetaTempo(bpm))
+	tr.Add(0, smf.MetaMeter(4, 4))
+	var last int64
+	for _, m := range msgs {
+		tr.Add(uint32(m.tick-last), m.msg)
+		last = m.tick
+	}
+	tr.Close(0)
+
+	s := smf.New()
+	s.TimeFormat = smf.MetricTicks(resolution)
+	if err := s.Add(tr); err != nil {
+		return fmt.Errorf("failed to build MIDI file: %w", err)
+	}
+	if err := s.WriteFile(path); err != nil {
+		return fmt.Errorf("failed to write MIDI file: %w", err)
+	}
+	fmt.Printf("Exported %d notes to %s\n", len(msgs)/2, path)
+	return nil
+}
@@ -0,0 +1,114 @@
+package audiopack
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"hello/cmdrun"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// record swaps Runner for a Recorder for the duration of the test.
+func record(t *testing.T, respond func(cmdrun.Call) (cmdrun.Result, error)) *cmdrun.Recorder {
+	t.Helper()
+	rec := &cmdrun.Recorder{Respond: respond}
+	old := Runner
+	Runner = rec
+	t.Cleanup(func() { Runner = old })
+	return rec
+}
+
+// golden compares got with testdata/<name>.golden, rewriting it with -update.
+func golden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from %s:\n got:\n%s\nwant:\n%s", name, path, got, want)
+	}
+}
+
+func TestExtractAudio(t *testing.T) {
+	rec := record(t, nil)
+	if err := ExtractAudio("my video.mp4", "audio.wav"); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "extract_audio", rec.Transcript())
+}
+
+func TestRunAubioNotes(t *testing.T) {
+	rec := record(t, func(c cmdrun.Call) (cmdrun.Result, error) {
+		return cmdrun.Result{Stdout: []byte("60.000000 0.100 0.600\n\n  62.000000 0.700 1.200  \n")}, nil
+	})
+	lines, err := RunAubioNotes("audio.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "aubionotes", rec.Transcript())
+
+	want := []string{"60.000000 0.100 0.600", "62.000000 0.700 1.200"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+}
+
+func TestRunAubioNotesError(t *testing.T) {
+	record(t, func(c cmdrun.Call) (cmdrun.Result, error) {
+		return cmdrun.Result{Stderr: []byte("AUBIO ERROR: source: failed opening audio.wav\n")}, errors.New("exit status 1")
+	})
+	_, err := RunAubioNotes("audio.wav")
+	if err == nil || !strings.Contains(err.Error(), "failed opening audio.wav") {
+		t.Errorf("error %v does not carry aubionotes stderr", err)
+	}
+}
+
+func TestExportMIDIRejectsTempo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.mid")
+	for _, bpm := range []float64{0, -120} {
+		if err := ExportMIDI([]NoteSegment{{Note: 60, Start: 0, End: 1}}, path, bpm); err == nil {
+			t.Errorf("ExportMIDI at %g BPM did not fail", bpm)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file written despite invalid tempo")
+	}
+}
+
+func TestTranscribeMelodyTempFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var wavPath string
+	record(t, func(c cmdrun.Call) (cmdrun.Result, error) {
+		if c.Name == "aubionotes" {
+			wavPath = c.Args[len(c.Args)-1]
+			return cmdrun.Result{Stdout: []byte("60.000000 0.100 0.600\n")}, nil
+		}
+		return cmdrun.Result{}, nil
+	})
+	events, err := TranscribeMelody("reference.mp3", DefaultMelodyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("got %d notes, want 1", len(events))
+	}
+	if filepath.Dir(wavPath) == "." || !strings.HasPrefix(filepath.Base(wavPath), "melody_reference_") {
+		t.Errorf("reference decoded to %q, want a temp file", wavPath)
+	}
+	if _, err := os.Stat(wavPath); !os.IsNotExist(err) {
+		t.Errorf("temp file %s was not removed", wavPath)
+	}
+}
@@ -0,0 +1,53 @@
+package audiopack
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"hello/cmdrun"
+)
+
+// RunAubioOnsets returns the onset times aubioonset finds in an audio file.
+func RunAubioOnsets(audioPath string) ([]float64, error) {
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(), "aubioonset", audioPath)
+	if err != nil {
+		return nil, fmt.Errorf("aubioonset %s: %w, output: %s", audioPath, err, strings.TrimSpace(string(res.Stderr)))
+	}
+
+	var onsets []float64
+	for _, line := range strings.Split(string(res.Stdout), "\n") {
+		if t, err := strconv.ParseFloat(strings.TrimSpace(line), 64); err == nil {
+			onsets = append(onsets, t)
+		}
+	}
+	sort.Float64s(onsets)
+	return onsets, nil
+}
+
+// DetectHits finds non-pitched hits (claps, pops, taps) by onset alone. Each
+// hit runs to the next onset, at most maxLength seconds; hits shorter than
+// 50ms are dropped. Note numbers the hits in order, for naming the clips.
+func DetectHits(audioPath string, maxLength float64) ([]NoteSegment, error) {
+	onsets, err := RunAubioOnsets(audioPath)
+	if err != nil {
+		return nil, fmt.Errorf("aubioonset failed: %w", err)
+	}
+
+	var hits []NoteSegment
+	for i, start := range onsets {
+		end := start + maxLength
+		if i+1 < len(onsets) {
+			end = math.Min(end, onsets[i+1])
+		}
+		if end-start < 0.05 {
+			continue
+		}
+		hits = append(hits, NoteSegment{Start: start, End: end, Note: len(hits)})
+	}
+	fmt.Println("Hits detected:", len(hits))
+	return hits, nil
+}
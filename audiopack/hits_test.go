@@ -0,0 +1,39 @@
+package audiopack
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"hello/cmdrun"
+)
+
+func TestDetectHits(t *testing.T) {
+	// Unsorted onsets; the hit at 1.00 is cut to 30ms by the next one and dropped
+	record(t, func(c cmdrun.Call) (cmdrun.Result, error) {
+		return cmdrun.Result{Stdout: []byte("1.030\n0.000\n0.200\n1.000\n\n")}, nil
+	})
+	hits, err := DetectHits("audio.wav", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []NoteSegment{
+		{Start: 0, End: 0.2, Note: 0},
+		{Start: 0.2, End: 0.7, Note: 1},
+		{Start: 1.03, End: 1.53, Note: 2},
+	}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("DetectHits = %+v, want %+v", hits, want)
+	}
+}
+
+func TestRunAubioOnsetsError(t *testing.T) {
+	record(t, func(c cmdrun.Call) (cmdrun.Result, error) {
+		return cmdrun.Result{Stderr: []byte("AUBIO ERROR: source: failed opening audio.wav\n")}, errors.New("exit status 1")
+	})
+	_, err := DetectHits("audio.wav", 0.5)
+	if err == nil || !strings.Contains(err.Error(), "failed opening audio.wav") {
+		t.Errorf("error %v does not carry aubioonset stderr", err)
+	}
+}
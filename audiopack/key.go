@@ -0,0 +1,122 @@
+package audiopack
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"hello/midiparse"
+)
+
+// Krumhansl-Kessler key profiles: how well each pitch class, from the tonic
+// up, fits a major or minor key.
+var (
+	majorProfile = [12]float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}
+	minorProfile = [12]float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}
+)
+
+// SnapToScale makes PrepareAudio correct out-of-key notes to the in-key
+// neighbour nearest their detected pitch instead of the nearest semitone.
+var SnapToScale bool
+
+// ScaleKey is the key notes are snapped to; nil detects it from the segments.
+var ScaleKey *midiparse.Key
+
+// DetectKey estimates the key of the segments by correlating their pitch
+// class histogram, weighted by duration, with the major and minor profiles
+// in all 12 transpositions. The correlation (-1 to 1) says how clear it is.
+func DetectKey(segments []NoteSegment) (midiparse.Key, float64, error) {
+	var hist [12]float64
+	var total float64
+	for _, seg := range segments {
+		d := seg.End - seg.Start
+		hist[((seg.Note%12)+12)%12] += d
+		total += d
+	}
+	if total <= 0 {
+		return midiparse.Key{}, 0, fmt.Errorf("no notes to detect a key from")
+	}
+
+	best, bestR := midiparse.Key{}, math.Inf(-1)
+	for tonic := 0; tonic < 12; tonic++ {
+		for _, minor := range []bool{false, true} {
+			profile := majorProfile
+			if minor {
+				profile = minorProfile
+			}
+			var rotated [12]float64
+			for pc := range rotated {
+				rotated[pc] = profile[(pc-tonic+12)%12]
+			}
+			if r := correlation(hist, rotated); r > bestR {
+				best, bestR = midiparse.Key{Tonic: tonic, Minor: minor}, r
+			}
+		}
+	}
+	return best, bestR, nil
+}
+
+// correlation is the Pearson correlation of two pitch class vectors.
+func correlation(a, b [12]float64) float64 {
+	var ma, mb float64
+	for i := range a {
+		ma += a[i] / 12
+		mb += b[i] / 12
+	}
+	var cov, va, vb float64
+	for i := range a {
+		cov += (a[i] - ma) * (b[i] - mb)
+		va += (a[i] - ma) * (a[i] - ma)
+		vb += (b[i] - mb) * (b[i] - mb)
+	}
+	if va == 0 || vb == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(va*vb)
+}
+
+// SnapSegments applies SnapToScale: every out-of-key note moves to the in-key
+// note a semitone above or below, whichever is closer to the detected pitch.
+// A note exactly between two in-key neighbours, or without a detected pitch,
+// moves up, so the same input always snaps the same way. Segments are
+// returned unchanged when snapping is off.
+func SnapSegments(segments []NoteSegment) []NoteSegment {
+	if !SnapToScale || len(segments) == 0 {
+		return segments
+	}
+	key := ScaleKey
+	if key == nil {
+		detected, _, err := DetectKey(segments)
+		if err != nil {
+			log.Printf("Warning: %v, not snapping to a scale", err)
+			return segments
+		}
+		key = &detected
+	}
+
+	out := make([]NoteSegment, len(segments))
+	moved := 0
+	for i, seg := range segments {
+		out[i] = seg
+		if key.Contains(seg.Note) {
+			continue
+		}
+		pitch := seg.Pitch
+		if pitch == 0 {
+			pitch = float64(seg.Note)
+		}
+		best := -1
+		// Above first: only a strictly closer note below replaces it
+		for _, n := range []int{seg.Note + 1, seg.Note - 1} {
+			if key.Contains(n) && (best < 0 || math.Abs(float64(n)-pitch) < math.Abs(float64(best)-pitch)) {
+				best = n
+			}
+		}
+		if best >= 0 {
+			out[i].Note = best
+			moved++
+		}
+	}
+	fmt.Printf("Snapped %d/%d notes to %s\n", moved, len(segments), key)
+	return out
+}
@@ -0,0 +1,43 @@
+package audiopack
+
+import (
+	"testing"
+
+	"hello/midiparse"
+)
+
+func TestParseAubioNotesRounds(t *testing.T) {
+	segments := parseAubioNotes([]string{"60.600000 0.0 0.5", "61.400000 0.5 1.0"}, 0)
+	for i, want := range []int{61, 61} {
+		if segments[i].Note != want {
+			t.Errorf("segment %d: note %d, want %d", i, segments[i].Note, want)
+		}
+	}
+}
+
+func TestSnapSegmentsTies(t *testing.T) {
+	key, err := midiparse.ParseKey("C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSnap, oldKey := SnapToScale, ScaleKey
+	SnapToScale, ScaleKey = true, &key
+	t.Cleanup(func() { SnapToScale, ScaleKey = oldSnap, oldKey })
+
+	// C# sits between C and D: ties and unknown pitch go up, otherwise nearest
+	tests := []struct {
+		pitch float64
+		want  int
+	}{
+		{61, 62},
+		{0, 62},
+		{60.8, 60},
+		{61.2, 62},
+	}
+	for _, tt := range tests {
+		got := SnapSegments([]NoteSegment{{Note: 61, Pitch: tt.pitch}})
+		if got[0].Note != tt.want {
+			t.Errorf("C# at pitch %.1f snapped to %d, want %d", tt.pitch, got[0].Note, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package audiopack
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"hello/midiparse"
+)
+
+// MelodyOptions controls how a reference recording is turned into notes.
+type MelodyOptions struct {
+	MinNoteLength float64 // seconds; shorter notes are dropped after merging
+	MergeGap      float64 // seconds; the same note resuming within this gap is one note
+	BPM           float64 // tempo of the quantize grid; 0 leaves timing alone
+	Grid          int     // quantize grid as a note value (16 = sixteenths)
+}
+
+// DefaultMelodyOptions suits a sung or played lead line.
+var DefaultMelodyOptions = MelodyOptions{
+	MinNoteLength: 0.08,
+	MergeGap:      0.05,
+	Grid:          16,
+}
+
+// TranscribeMelody extracts the monophonic melody of a reference audio file
+// with aubionotes and returns it as note events, cleaned up and optionally
+// quantized.
+func TranscribeMelody(audioPath string, opts MelodyOptions) ([]midiparse.NoteEvent, error) {
+	wav, err := os.CreateTemp("", "melody_reference_*.wav")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	wav.Close()
+	wavPath := wav.Name()
+	defer os.Remove(wavPath)
+
+	if err := ExtractAudio(audioPath, wavPath); err != nil {
+		return nil, fmt.Errorf("decoding reference audio: %w", err)
+	}
+
+	lines, err := RunAubioNotes(wavPath)
+	if err != nil {
+		return nil, fmt.Errorf("aubionotes failed: %w", err)
+	}
+
+	segments := cleanMelody(parseAubioNotes(lines, 0), opts)
+	events := make([]midiparse.NoteEvent, 0, len(segments))
+	for _, seg := range segments {
+		events = append(events, midiparse.NoteEvent{
+			Note:     seg.Note,
+			Start:    seg.Start,
+			Duration: seg.End - seg.Start,
+			Velocity: 100,
+		})
+	}
+	fmt.Printf("Melody notes transcribed: %d\n", len(events))
+	return events, nil
+}
+
+// parseAubioNotes parses aubionotes lines ("note start end"), keeping
+// segments at least minLength long.
+func parseAubioNotes(lines []string, minLength float64) []NoteSegment {
+	var segments []NoteSegment
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		start, err1 := strconv.ParseFloat(fields[1], 64)
+		end, err2 := strconv.ParseFloat(fields[2], 64)
+		noteFloat, err3 := strconv.ParseFloat(fields[0], 64)
+		if err1 == nil && err2 == nil && err3 == nil && (end-start) >= minLength {
+			segments = append(segments, NoteSegment{Start: start, End: end, Note: int(math.Round(noteFloat)), Pitch: noteFloat})
+		}
+	}
+	return segments
+}
+
+// cleanMelody makes segments a clean monophonic line: sorted, overlaps cut
+// at the next onset, repeated notes across short gaps merged, then short
+// notes dropped and the rest quantized.
+func cleanMelody(segments []NoteSegment, opts MelodyOptions) []NoteSegment {
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Start < segments[j].Start
+	})
+
+	var line []NoteSegment
+	for _, seg := range segments {
+		if n := len(line); n > 0 {
+			prev := &line[n-1]
+			if prev.Note == seg.Note && seg.Start-prev.End <= opts.MergeGap {
+				prev.End = math.Max(prev.End, seg.End)
+				continue
+			}
+			prev.End = math.Min(prev.End, seg.Start)
+		}
+		line = append(line, seg)
+	}
+
+	var out []NoteSegment
+	for _, seg := range line {
+		if seg.End-seg.Start < opts.MinNoteLength {
+			continue
+		}
+		if opts.BPM > 0 && opts.Grid > 0 {
+			grid := 60 / opts.BPM * 4 / float64(opts.Grid)
+			seg.Start = math.Round(seg.Start/grid) * grid
+			seg.End = math.Round(seg.End/grid) * grid
+			if n := len(out); n > 0 && out[n-1].End > seg.Start {
+				out[n-1].End = seg.Start
+				if out[n-1].End <= out[n-1].Start {
+					out = out[:n-1]
+				}
+			}
+			if seg.End <= seg.Start {
+				continue
+			}
+		}
+		out = append(out, seg)
+	}
+	return out
+}
@@ -0,0 +1,321 @@
+package buildoutput
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"hello/cmdrun"
+	"hello/ffgraph"
+	"hello/midiparse"
+)
+
+// BackgroundKind is the source of a background section.
+type BackgroundKind string
+
+const (
+	BackgroundColor    BackgroundKind = "color"
+	BackgroundGradient BackgroundKind = "gradient"
+	BackgroundImage    BackgroundKind = "image"
+	BackgroundVideo    BackgroundKind = "video" // looped for the whole section
+)
+
+// Background is one section of the scene behind the notes. A section runs
+// from its start until the next section starts. Start is either given in
+// seconds or taken from the MIDI marker whose text equals Marker.
+type Background struct {
+	Kind   BackgroundKind `json:"kind"`
+	Color  string         `json:"color"`  // ffmpeg color, e.g. "navy" or "0x202040"
+	Color2 string         `json:"color2"` // second gradient color
+	Path   string         `json:"path"`   // image or video file
+	Start  float64        `json:"start"`
+	Marker string         `json:"marker"`
+}
+
+// Backgrounds are the scene sections, sorted by Start. Empty means black.
+var Backgrounds []Background
+
+// LoadBackgrounds reads a JSON array of background sections.
+func LoadBackgrounds(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read backgrounds: %w", err)
+	}
+	var sections []Background
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return fmt.Errorf("failed to parse backgrounds %s: %w", path, err)
+	}
+	for i, b := range sections {
+		switch b.Kind {
+		case BackgroundColor, BackgroundGradient:
+			if b.Color == "" {
+				return fmt.Errorf("background %d: %s needs a color", i, b.Kind)
+			}
+			if b.Kind == BackgroundGradient && b.Color2 == "" {
+				return fmt.Errorf("background %d: gradient needs color2", i)
+			}
+		case BackgroundImage, BackgroundVideo:
+			if _, err := os.Stat(b.Path); err != nil {
+				return fmt.Errorf("background %d: %w", i, err)
+			}
+		default:
+			return fmt.Errorf("background %d: unknown kind %q", i, b.Kind)
+		}
+	}
+	Backgrounds = sections
+	sortBackgrounds()
+	return nil
+}
+
+// ResolveBackgroundMarkers sets the start of every section that names a
+// marker to that marker's time.
+func ResolveBackgroundMarkers(markers []midiparse.Marker) error {
+	for i, b := range Backgrounds {
+		if b.Marker == "" {
+			continue
+		}
+		found := false
+		for _, m := range markers {
+			if m.Text == b.Marker {
+				Backgrounds[i].Start = m.Time
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("background marker %q not found in MIDI file", b.Marker)
+		}
+	}
+	sortBackgrounds()
+	return nil
+}
+
+func sortBackgrounds() {
+	sort.SliceStable(Backgrounds, func(i, j int) bool {
+		return Backgrounds[i].Start < Backgrounds[j].Start
+	})
+}
+
+// backgroundSpan is the part of a section inside a render window, with times
+// relative to the window start.
+type backgroundSpan struct {
+	Background
+	from, to float64 // window-relative
+	skip     float64 // how far into the section the window starts
+}
+
+// backgroundSpans clips the sections to [offset, offset+duration).
+func backgroundSpans(offset, duration float64) []backgroundSpan {
+	var spans []backgroundSpan
+	for i, b := range Backgrounds {
+		end := math.Inf(1)
+		if i+1 < len(Backgrounds) {
+			end = Backgrounds[i+1].Start
+		}
+		from := math.Max(b.Start, offset)
+		to := math.Min(end, offset+duration)
+		if to <= from {
+			continue
+		}
+		spans = append(spans, backgroundSpan{
+			Background: b,
+			from:       from - offset,
+			to:         to - offset,
+			skip:       from - b.Start,
+		})
+	}
+	return spans
+}
+
+// gradientMinSpeed is the lowest speed ffmpeg's gradients filter accepts.
+const gradientMinSpeed = 0.00001
+
+// backgroundSource returns the source filters producing a section at the
+// output size and frame rate, starting at the section's own time zero.
+func backgroundSource(b Background) []*ffgraph.Filter {
+	p := OutputProfile
+	fill := []*ffgraph.Filter{
+		ffgraph.NewFilter("scale").Argf("%d", p.Width).Argf("%d", p.Height).Set("force_original_aspect_ratio", "increase"),
+		ffgraph.NewFilter("crop").Argf("%d", p.Width).Argf("%d", p.Height),
+		ffgraph.NewFilter("setsar").Arg("1"),
+	}
+
+	switch b.Kind {
+	case BackgroundGradient:
+		// gradients rejects a speed of 0; at its minimum the gradient
+		// barely moves over the length of a song
+		return []*ffgraph.Filter{
+			ffgraph.NewFilter("gradients").Set("s", p.Size()).Setf("r", "%d", p.FPS).
+				Set("c0", b.Color).Set("c1", b.Color2).Setf("speed", "%g", gradientMinSpeed),
+		}
+	case BackgroundImage:
+		return append([]*ffgraph.Filter{
+			ffgraph.NewFilter("movie").Set("filename", b.Path),
+			ffgraph.NewFilter("loop").Set("loop", "-1").Set("size", "1"),
+			ffgraph.NewFilter("fps").Argf("%d", p.FPS),
+		}, fill...)
+	case BackgroundVideo:
+		// Read from a looped input (see addBackground), not a movie source
+		return append([]*ffgraph.Filter{
+			ffgraph.NewFilter("setpts").Arg("N/FRAME_RATE/TB"),
+			ffgraph.NewFilter("fps").Argf("%d", p.FPS),
+		}, fill...)
+	default:
+		return []*ffgraph.Filter{
+			ffgraph.NewFilter("color").Set("c", b.Color).Set("s", p.Size()).Setf("r", "%d", p.FPS),
+		}
+	}
+}
+
+// addBackground builds the background for a render window into g and returns
+// its pad. Without sections this is the plain black color source. Video
+// sections are looped inputs seeked to the window, so a batch does not
+// decode the video from the section start.
+func addBackground(g *ffgraph.Graph, offset, duration float64) (ffgraph.Pad, error) {
+	p := OutputProfile
+	bg := g.Source("bg",
+		ffgraph.NewFilter("color").Arg("black").Set("s", p.Size()).Setf("r", "%d", p.FPS).Setf("d", "%.3f", duration),
+		ffgraph.NewFilter("format").Arg("yuv420p"),
+	)
+
+	for _, span := range backgroundSpans(offset, duration) {
+		filters := backgroundSource(span.Background)
+		trim := ffgraph.NewFilter("trim").Setf("start", "%.3f", span.skip).Setf("duration", "%.3f", span.to-span.from)
+		if span.Kind == BackgroundVideo {
+			trim = ffgraph.NewFilter("trim").Setf("duration", "%.3f", span.to-span.from)
+		}
+		filters = append(filters,
+			trim,
+			ffgraph.NewFilter("setpts").Argf("PTS-STARTPTS+%.3f/TB", span.from),
+			ffgraph.NewFilter("format").Arg("yuv420p"),
+		)
+
+		var layer ffgraph.Pad
+		if span.Kind == BackgroundVideo {
+			length, err := probeDuration(span.Path)
+			if err != nil {
+				return ffgraph.Pad{}, fmt.Errorf("background video: %w", err)
+			}
+			in := g.AddInputWithOptions(span.Path,
+				"-stream_loop", "-1",
+				"-ss", fmt.Sprintf("%.3f", math.Mod(span.skip, length)))
+			layer = g.Apply(g.Stream(in, "v"), "bgs", filters...)
+		} else {
+			layer = g.Source("bgs", filters...)
+		}
+		bg = g.Combine([]ffgraph.Pad{bg, layer}, "bg", ffgraph.NewFilter("overlay").Set("shortest", "0").Set("eof_action", "pass"))
+	}
+	return bg, nil
+}
+
+// backgroundLayers draws the background sections for the compositor backend.
+// Colors, gradients and images are rendered by ffmpeg once as a still frame;
+// a video section is streamed from a looped decoder while it is on screen,
+// so only its current frame is held.
+type backgroundLayers struct {
+	stills  map[int][]byte // by section index
+	stream  *clipStream    // the video section on screen, if any
+	section int            // section index of stream
+}
+
+// decodeBackgrounds renders the still sections that start before maxEnd.
+func decodeBackgrounds(ctx context.Context, maxEnd float64) (*backgroundLayers, error) {
+	runner := cmdrun.Silenced(Runner)
+	p := OutputProfile
+	frameSize := p.Width * p.Height * 4
+	layers := &backgroundLayers{stills: map[int][]byte{}}
+
+	for i, b := range Backgrounds {
+		if b.Start >= maxEnd || b.Kind == BackgroundVideo {
+			continue
+		}
+		var args []string
+		switch b.Kind {
+		case BackgroundImage:
+			args = []string{"-v", "error", "-i", b.Path}
+		default:
+			args = []string{"-v", "error", "-f", "lavfi", "-i", filterChain(backgroundSource(b))}
+		}
+		args = append(args,
+			"-vf", filterChain(backgroundFill()),
+			"-frames:v", "1",
+			"-pix_fmt", "rgba", "-f", "rawvideo", "-")
+
+		fmt.Printf("Decoding background %d (%s)\n", i, b.Kind)
+		res, err := runner.Run(ctx, "ffmpeg", args...)
+		if err != nil {
+			return nil, fmt.Errorf("decoding background %d failed: %w, output: %s", i, err, string(res.Stderr))
+		}
+		if len(res.Stdout) < frameSize {
+			return nil, fmt.Errorf("decoding background %d: no frame", i)
+		}
+		layers.stills[i] = res.Stdout[:frameSize]
+	}
+	return layers, nil
+}
+
+// backgroundFill scales and crops a background to fill the output frame at
+// the output frame rate.
+func backgroundFill() []*ffgraph.Filter {
+	p := OutputProfile
+	return []*ffgraph.Filter{
+		ffgraph.NewFilter("scale").Argf("%d", p.Width).Argf("%d", p.Height).Set("force_original_aspect_ratio", "increase"),
+		ffgraph.NewFilter("crop").Argf("%d", p.Width).Argf("%d", p.Height),
+		ffgraph.NewFilter("fps").Argf("%d", p.FPS),
+	}
+}
+
+// draw fills frame with the background at time t. Times only move forward,
+// so a video section's stream is read on and closed once it is replaced.
+func (l *backgroundLayers) draw(ctx context.Context, frame []byte, t float64) error {
+	clearFrame(frame)
+	i := len(Backgrounds) - 1
+	for i >= 0 && Backgrounds[i].Start > t {
+		i--
+	}
+	if l.stream != nil && l.section != i {
+		l.close()
+	}
+	if i < 0 {
+		return nil
+	}
+
+	b := Backgrounds[i]
+	if b.Kind != BackgroundVideo {
+		if still := l.stills[i]; still != nil {
+			copy(frame, still)
+		}
+		return nil
+	}
+	if l.stream == nil {
+		l.stream = openFrameStream(ctx, b.Path,
+			"-v", "error",
+			"-stream_loop", "-1",
+			"-i", b.Path,
+			"-vf", filterChain(backgroundFill()),
+			"-pix_fmt", "rgba",
+			"-f", "rawvideo",
+			"-",
+		)
+		l.section = i
+	}
+	video, err := l.stream.frameAt(frameIndex(t-b.Start, float64(OutputProfile.FPS)))
+	if err != nil {
+		return fmt.Errorf("background %d: %w", i, err)
+	}
+	if video != nil {
+		copy(frame, video)
+	}
+	return nil
+}
+
+// close stops the video section's decoder, if one is running.
+func (l *backgroundLayers) close() {
+	if l.stream != nil {
+		l.stream.close()
+		l.stream = nil
+	}
+}
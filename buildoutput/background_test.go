@@ -0,0 +1,128 @@
+package buildoutput
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"hello/cmdrun"
+	"hello/ffgraph"
+)
+
+func TestLoadBackgroundsGradientNeedsColor2(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bg.json")
+	if err := os.WriteFile(path, []byte(`[{"kind": "gradient", "color": "navy"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadBackgrounds(path); err == nil || !strings.Contains(err.Error(), "color2") {
+		t.Errorf("LoadBackgrounds = %v, want a missing color2 error", err)
+	}
+}
+
+func TestBackgroundVideoSeeksToWindow(t *testing.T) {
+	oldRunner, oldBackgrounds := Runner, Backgrounds
+	t.Cleanup(func() { Runner, Backgrounds = oldRunner, oldBackgrounds; delete(durations, "loop.mp4") })
+	Runner = &cmdrun.Recorder{Respond: func(c cmdrun.Call) (cmdrun.Result, error) {
+		return cmdrun.Result{Stdout: []byte("10.000000\n")}, nil
+	}}
+	Backgrounds = []Background{{Kind: BackgroundVideo, Path: "loop.mp4", Start: 5}}
+
+	// A batch starting 27.5s into the song is 22.5s into the section: the
+	// 10s video loops twice and the input is seeked 2.5s in
+	g := ffgraph.New()
+	bg, err := addBackground(g, 27.5, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Output(bg)
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(g.InputArgs(), " "), "-stream_loop -1 -ss 2.500 -i loop.mp4"; got != want {
+		t.Errorf("input args = %q, want %q", got, want)
+	}
+	if script := g.String(); strings.Contains(script, "trim=start") {
+		t.Errorf("video section still trims from its start: %s", script)
+	}
+}
+
+// TestBackgroundLayersStreamVideo checks that the compositor renders still
+// sections once and streams a video section only while it is on screen.
+func TestBackgroundLayersStreamVideo(t *testing.T) {
+	oldRunner, oldProfile, oldBackgrounds := Runner, OutputProfile, Backgrounds
+	t.Cleanup(func() { Runner, OutputProfile, Backgrounds = oldRunner, oldProfile, oldBackgrounds })
+	OutputProfile.Width, OutputProfile.Height, OutputProfile.FPS = 2, 1, 10
+
+	rec := &cmdrun.Recorder{Respond: func(c cmdrun.Call) (cmdrun.Result, error) {
+		args := strings.Join(c.Args, " ")
+		switch {
+		case strings.Contains(args, "loop.mp4"):
+			return cmdrun.Result{Stdout: []byte{50, 0, 0, 255, 50, 0, 0, 255, 60, 0, 0, 255, 60, 0, 0, 255}}, nil
+		case strings.Contains(args, "c=red"):
+			return cmdrun.Result{Stdout: []byte{200, 0, 0, 255, 200, 0, 0, 255}}, nil
+		default:
+			return cmdrun.Result{Stdout: []byte{100, 0, 0, 255, 100, 0, 0, 255}}, nil
+		}
+	}}
+	Runner = rec
+	Backgrounds = []Background{
+		{Kind: BackgroundColor, Color: "red", Start: 0},
+		{Kind: BackgroundVideo, Path: "loop.mp4", Start: 0.25},
+		{Kind: BackgroundColor, Color: "blue", Start: 0.6},
+	}
+
+	layers, err := decodeBackgrounds(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layers.close()
+
+	// The fake decoder stops after two frames, leaving black until blue
+	want := []byte{200, 200, 200, 50, 60, 0, 100}
+	frame := make([]byte, 8)
+	for f, r := range want {
+		if err := layers.draw(context.Background(), frame, float64(f)/10); err != nil {
+			t.Fatal(err)
+		}
+		if frame[0] != r {
+			t.Errorf("frame %d red = %d, want %d", f, frame[0], r)
+		}
+	}
+	if layers.stream != nil {
+		t.Errorf("video stream still open after its section ended")
+	}
+	if n := strings.Count(rec.Transcript(), "-stream_loop -1 -i loop.mp4"); n != 1 {
+		t.Errorf("video decoded %d times, want once:\n%s", n, rec.Transcript())
+	}
+}
+
+// TestGradientSourceAccepted checks the gradient source against the option
+// range of ffmpeg's gradients filter and, where ffmpeg is installed, that
+// ffmpeg accepts the graph.
+func TestGradientSourceAccepted(t *testing.T) {
+	chain := filterChain(backgroundSource(Background{Kind: BackgroundGradient, Color: "navy", Color2: "0x202040"}))
+	var speed float64
+	for _, opt := range strings.Split(chain, ":") {
+		if v, ok := strings.CutPrefix(opt, "speed="); ok {
+			var err error
+			if speed, err = strconv.ParseFloat(v, 64); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if speed < 0.00001 || speed > 1 {
+		t.Errorf("gradients speed %g outside ffmpeg's range [0.00001, 1] in %s", speed, chain)
+	}
+
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	out, err := exec.Command("ffmpeg", "-v", "error", "-f", "lavfi", "-i", chain, "-frames:v", "1", "-f", "null", "-").CombinedOutput()
+	if err != nil {
+		t.Errorf("ffmpeg rejected %s: %v\n%s", chain, err, out)
+	}
+}
@@ -0,0 +1,189 @@
+package buildoutput
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"hello/cmdrun"
+	"hello/ffgraph"
+)
+
+// BackingTrack is a WAV/MP3 mixed under the generated notes.
+type BackingTrack struct {
+	Path   string
+	Offset float64 // song time the track starts at; negative skips into the track
+	Until  float64 // song time the track stops at, e.g. the end of a bar range; 0 plays it out
+	GainDB float64
+	Duck   bool // lower the track while notes sound (sidechain compression)
+
+	duration float64 // probed once by end()
+}
+
+// Backing is the backing track for the render, or nil for notes only.
+var Backing *BackingTrack
+
+// Ducking settings, shared by the filter graph (sidechaincompress) and the
+// compositor's Go implementation so both backends sound the same.
+const (
+	duckThreshold = 0.05 // linear amplitude of the note mix where ducking starts
+	duckRatio     = 6.0
+	duckAttackMS  = 5.0
+	duckReleaseMS = 250.0
+)
+
+// end probes the track length and returns the song time it finishes at.
+func (b *BackingTrack) end() (float64, error) {
+	if b.duration == 0 {
+		d, err := probeDuration(b.Path)
+		if err != nil {
+			return 0, fmt.Errorf("backing track: %w", err)
+		}
+		b.duration = d
+	}
+	end := b.Offset + b.duration
+	if b.Until > 0 {
+		end = math.Min(end, b.Until)
+	}
+	return end, nil
+}
+
+// durations caches probeDuration by path.
+var durations = map[string]float64{}
+
+// probeDuration returns the length of a media file in seconds.
+func probeDuration(path string) (float64, error) {
+	if d, ok := durations[path]; ok {
+		return d, nil
+	}
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(),
+		"ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "csv=p=0",
+		path,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe of %s failed: %w", path, err)
+	}
+	d, err := strconv.ParseFloat(strings.TrimSpace(string(res.Stdout)), 64)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("could not parse duration %q of %s", string(res.Stdout), path)
+	}
+	durations[path] = d
+	return d, nil
+}
+
+// addBacking mixes the backing track window [offset, offset+duration) under
+// the note mix and returns the mixed pad. Without a backing track, or when
+// the track is silent for the whole window, notes is returned unchanged.
+func addBacking(g *ffgraph.Graph, notes ffgraph.Pad, offset, duration float64) ffgraph.Pad {
+	if Backing == nil {
+		return notes
+	}
+
+	trackStart := offset - Backing.Offset
+	delay := 0.0
+	if trackStart < 0 {
+		delay = -trackStart
+		trackStart = 0
+	}
+	length := duration - delay
+	if Backing.Until > 0 {
+		length = math.Min(length, Backing.Until-offset-delay)
+	}
+	if length <= 0 {
+		return notes
+	}
+
+	// Seek on the input so each batch decodes only its own window of the track
+	in := g.AddInputWithOptions(Backing.Path,
+		"-ss", fmt.Sprintf("%.3f", trackStart),
+		"-t", fmt.Sprintf("%.3f", length))
+	filters := []*ffgraph.Filter{
+		ffgraph.NewFilter("asetpts").Arg("PTS-STARTPTS"),
+		ffgraph.NewFilter("aresample").Argf("%d", OutputProfile.SampleRate),
+		ffgraph.NewFilter("aformat").Set("channel_layouts", "stereo"),
+	}
+	if delay > 0 {
+		filters = append(filters, ffgraph.NewFilter("adelay").Setf("delays", "%d", int(delay*1000)).Set("all", "1"))
+	}
+	filters = append(filters, ffgraph.NewFilter("volume").Setf("volume", "%.2fdB", Backing.GainDB))
+	backing := g.Apply(g.Stream(in, "a"), "bk", filters...)
+
+	if Backing.Duck {
+		split := g.ASplit(notes, 2, "n")
+		notes = split[0]
+		backing = g.Combine([]ffgraph.Pad{backing, split[1]}, "bk",
+			ffgraph.NewFilter("sidechaincompress").
+				Setf("threshold", "%g", duckThreshold).
+				Setf("ratio", "%g", duckRatio).
+				Setf("attack", "%g", duckAttackMS).
+				Setf("release", "%g", duckReleaseMS))
+	}
+
+	// duration=first: the note mix carries the silence source, so it always
+	// spans the whole window
+	return g.Combine([]ffgraph.Pad{notes, backing}, "mix",
+		amixFilter(2, "first"))
+}
+
+// decodeBacking decodes the backing track to interleaved stereo PCM at the
+// output sample rate for the compositor.
+func decodeBacking(ctx context.Context) ([]int16, error) {
+	res, err := cmdrun.Silenced(Runner).Run(ctx,
+		"ffmpeg",
+		"-v", "error",
+		"-i", Backing.Path,
+		"-vn",
+		"-f", "s16le",
+		"-ar", fmt.Sprintf("%d", OutputProfile.SampleRate),
+		"-ac", fmt.Sprintf("%d", compositeChannels),
+		"-",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("decoding backing track failed: %w, output: %s", err, string(res.Stderr))
+	}
+	samples := make([]int16, len(res.Stdout)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(res.Stdout[2*i:]))
+	}
+	return samples, nil
+}
+
+// mixBacking adds the backing track into mix in place, applying gain and,
+// if enabled, ducking driven by the note mix already in the buffer.
+func mixBacking(mix []float32, backing []int16) {
+	sampleRate := float64(OutputProfile.SampleRate)
+	gain := dbToLinear(Backing.GainDB)
+	attack := math.Exp(-1 / (duckAttackMS / 1000 * sampleRate))
+	release := math.Exp(-1 / (duckReleaseMS / 1000 * sampleRate))
+
+	offset := int(math.Round(Backing.Offset*sampleRate)) * compositeChannels
+	until := int(math.Round(Backing.Until*sampleRate)) * compositeChannels
+	env := 0.0
+	for i := 0; i+1 < len(mix); i += compositeChannels {
+		duck := 1.0
+		if Backing.Duck {
+			level := math.Max(math.Abs(float64(mix[i])), math.Abs(float64(mix[i+1]))) / math.MaxInt16
+			if level > env {
+				env = attack*env + (1-attack)*level
+			} else {
+				env = release*env + (1-release)*level
+			}
+			if env > duckThreshold {
+				duck = (duckThreshold + (env-duckThreshold)/duckRatio) / env
+			}
+		}
+
+		j := i - offset
+		if j < 0 || j+1 >= len(backing) || (Backing.Until > 0 && i >= until) {
+			continue
+		}
+		mix[i] += float32(float64(backing[j]) * gain * duck)
+		mix[i+1] += float32(float64(backing[j+1]) * gain * duck)
+	}
+}
@@ -0,0 +1,40 @@
+package buildoutput
+
+import (
+	"strings"
+	"testing"
+
+	"hello/ffgraph"
+)
+
+func TestBackingSeeksPerWindow(t *testing.T) {
+	old := Backing
+	t.Cleanup(func() { Backing = old })
+
+	tests := []struct {
+		name          string
+		offset, until float64
+		start, length float64
+		want          string
+	}{
+		{"into the track", 2, 0, 30, 4, "-ss 28.000 -t 4.000 -i backing.wav"},
+		{"before the track", 2, 0, 0, 4, "-ss 0.000 -t 2.000 -i backing.wav"},
+		{"cut at bar range", 2, 32, 30, 4, "-ss 28.000 -t 2.000 -i backing.wav"},
+		{"after the bar range", 2, 32, 34, 4, ""},
+	}
+	for _, tt := range tests {
+		Backing = &BackingTrack{Path: "backing.wav", Offset: tt.offset, Until: tt.until}
+		g := ffgraph.New()
+		notes := g.Source("notes", ffgraph.NewFilter("anullsrc"))
+		g.Output(addBacking(g, notes, tt.start, tt.length))
+		if err := g.Validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := strings.Join(g.InputArgs(), " "); got != tt.want {
+			t.Errorf("%s: input args = %q, want %q", tt.name, got, tt.want)
+		}
+		if strings.Contains(g.String(), "atrim") {
+			t.Errorf("%s: backing is still trimmed in the graph: %s", tt.name, g.String())
+		}
+	}
+}
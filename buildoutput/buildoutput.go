@@ -1,16 +1,38 @@
 package buildoutput
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 
+	"hello/cmdrun"
+	"hello/ffgraph"
 	"hello/midiparse"
+	"hello/profile"
 )
 
+// Runner executes the ffmpeg render and concat commands. Swap it for a
+// *cmdrun.Recorder to golden-test the generated command lines.
+var Runner cmdrun.Runner = cmdrun.Default
+
+// OutputProfile is the resolution, frame rate and encoder settings used for
+// every batch, so the segments can be joined with -c copy.
+var OutputProfile = profile.Default()
+
+// MaxEventsPerBatch is how many note events go into one ffmpeg pass. The
+// filter graph is passed as a script file, so the limit is no longer the
+// command line length but ffmpeg's memory for open decoders (one per distinct
+// clip) and the split/asplit branch buffers. 50 is carried over from the old
+// inline graph and has not been measured since; it is a starting point, not
+// a tuned value. Raise it with -batch-size to cut the number of concat
+// segments.
+var MaxEventsPerBatch = 50
+
 // BuildFFmpegCommandWithAudio coordinates the build process, either in a single pass or in batches.
 func BuildFFmpegCommandWithAudio(events []midiparse.NoteEvent, outputFile string) error {
 	fmt.Println("\n\n\n\nBuilding FFmpeg command...\n\n\n\n\n", events)
@@ -21,6 +43,14 @@ func BuildFFmpegCommandWithAudio(events []midiparse.NoteEvent, outputFile string
 	sort.Slice(events, func(i, j int) bool {
 		return events[i].Start < events[j].Start
 	})
+	holdDrums(events)
+	numberTakes(events)
+	songEvents = nil
+	for _, e := range events {
+		if !e.IsDrum() {
+			songEvents = append(songEvents, e)
+		}
+	}
 
 	// Calculate total duration (absolute end time of the last event)
 	maxEnd := 0.0
@@ -31,69 +61,112 @@ func BuildFFmpegCommandWithAudio(events []midiparse.NoteEvent, outputFile string
 		}
 	}
 
-	// If we have too many events, process in segments
-	const maxEventsPerBatch = 50
-	if len(events) > maxEventsPerBatch {
-		return buildFFmpegInBatches(events, outputFile, maxEnd, maxEventsPerBatch)
+	// A backing track can run past the last note; render the full song
+	if Backing != nil {
+		end, err := Backing.end()
+		if err != nil {
+			return err
+		}
+		maxEnd = math.Max(maxEnd, end)
 	}
 
-	// Original implementation for smaller sets
-	return buildFFmpegSinglePass(events, outputFile, maxEnd)
+	var err error
+	switch {
+	case RenderBackend == BackendCompositor:
+		err = renderComposited(events, outputFile, maxEnd)
+	case len(events) > MaxEventsPerBatch:
+		// If we have too many events, process in segments
+		err = buildFFmpegInBatches(events, outputFile, maxEnd, MaxEventsPerBatch)
+	default:
+		// Original implementation for smaller sets
+		err = buildFFmpegSinglePass(events, outputFile, 0, maxEnd)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Loudness is normalised over the whole song so segments share one gain
+	return normalizeLoudness(outputFile)
+}
+
+// batchBounds splits sorted events into [from, to) runs of at most size
+// events, moving each split back so notes starting together (a chord) always
+// land in the same batch. A chord larger than size becomes one batch.
+func batchBounds(events []midiparse.NoteEvent, size int) [][2]int {
+	var bounds [][2]int
+	for i := 0; i < len(events); {
+		end := min(i+size, len(events))
+		for end < len(events) && end > i && events[end].Start == events[end-1].Start {
+			end--
+		}
+		if end == i {
+			for end = i + 1; end < len(events) && events[end].Start == events[i].Start; end++ {
+			}
+		}
+		bounds = append(bounds, [2]int{i, end})
+		i = end
+	}
+	return bounds
 }
 
 // buildFFmpegInBatches processes events in smaller groups to create temporary segment files.
 func buildFFmpegInBatches(events []midiparse.NoteEvent, outputFile string, maxEnd float64, batchSize int) error {
 	tempSegments := []string{}
+	bounds := batchBounds(events, batchSize)
 
-	// Process in batches
-	for i := 0; i < len(events); i += batchSize {
-		end := i + batchSize
-		if end > len(events) {
-			end = len(events)
-		}
+	// Notes of earlier batches still sounding at the start of the current one
+	var held []midiparse.NoteEvent
 
-		batchEvents := events[i:end]
+	for n, b := range bounds {
+		batchEvents := events[b[0]:b[1]]
 
-		// 1. Determine the absolute start time of the segment
+		// 1. The segment runs from this batch's first event to the next batch's
+		// first event, so the segments tile the song without gaps or overlap and
+		// stay in sync with the backing track. The first segment starts at 0.
 		batchStart := batchEvents[0].Start
-
-		// 2. Calculate the segment's full duration
-		batchMaxEnd := 0.0
-		for _, e := range batchEvents {
-			eventEnd := e.Start + e.Duration
-			if eventEnd > batchMaxEnd {
-				batchMaxEnd = eventEnd
-			}
+		if n == 0 {
+			batchStart = 0
 		}
-		// The duration of the segment is the time from the first event's start to the last event's end.
-		segmentDuration := batchMaxEnd - batchStart
-
-		// 3. Create a time-shifted slice of events (Fix for black screen issue)
-		shiftedEvents := make([]midiparse.NoteEvent, len(batchEvents))
-		for j, e := range batchEvents {
+		batchEnd := maxEnd
+		if b[1] < len(events) {
+			batchEnd = events[b[1]].Start
+		}
+		segmentDuration := batchEnd - batchStart
+
+		// 2. Create a time-shifted slice of events (Fix for black screen issue).
+		// Held notes come first with a negative start: they pick up their clip
+		// where the previous segment cut it. Notes still sounding at the end of
+		// the segment are cut there and carried into the next one.
+		shiftedEvents := make([]midiparse.NoteEvent, 0, len(held)+len(batchEvents))
+		var carry []midiparse.NoteEvent
+		for _, e := range append(held, batchEvents...) {
+			if e.Start+e.Duration > batchEnd {
+				carry = append(carry, e)
+			}
 			// Shift the start time to be relative to the segment's start (0)
-			shiftedEvents[j] = midiparse.NoteEvent{
-				Note:     e.Note,
-				Start:    e.Start - batchStart, // Corrected time-shift
-				Duration: e.Duration,
-				// Removed non-existent fields: Velocity and Channel
+			e.Start -= batchStart // Corrected time-shift
+			e.Duration = math.Min(e.Duration, segmentDuration-e.Start)
+			if e.Duration <= 0 {
+				continue
 			}
+			shiftedEvents = append(shiftedEvents, e)
 		}
+		held = carry
 
-		segmentFile := fmt.Sprintf("temp_segment_%d.mp4", i/batchSize)
+		segmentFile := fmt.Sprintf("temp_segment_%d.mp4", n)
 		tempSegments = append(tempSegments, segmentFile)
 
-		fmt.Printf("Processing batch %d/%d (start: %.3f, duration: %.3f)...\n",
-			i/batchSize+1, (len(events)+batchSize-1)/batchSize, batchStart, segmentDuration)
+		fmt.Printf("Processing batch %d/%d (start: %.3f, duration: %.3f, held notes: %d)...\n",
+			n+1, len(bounds), batchStart, segmentDuration, len(shiftedEvents)-len(batchEvents))
 
-		// 4. Pass the time-shifted events and the relative segment duration
-		err := buildFFmpegSinglePass(shiftedEvents, segmentFile, segmentDuration)
+		// 3. Pass the time-shifted events and the relative segment duration
+		err := buildFFmpegSinglePass(shiftedEvents, segmentFile, batchStart, segmentDuration)
 		if err != nil {
 			// Clean up temp files
 			// for _, seg := range tempSegments {
 			// 	os.Remove(seg)
 			// }
-			return fmt.Errorf("failed to build segment %d: %w", i/batchSize, err)
+			return fmt.Errorf("failed to build segment %d: %w", n, err)
 		}
 	}
 
@@ -102,7 +175,10 @@ func buildFFmpegInBatches(events []midiparse.NoteEvent, outputFile string, maxEn
 }
 
 // buildFFmpegSinglePass creates a video/audio file for a set of events.
-func buildFFmpegSinglePass(events []midiparse.NoteEvent, outputFile string, maxEnd float64) error {
+// offset is the absolute song time the (time-shifted) events start at. An
+// event with a negative start began before the segment and is played from
+// -Start seconds into its clip.
+func buildFFmpegSinglePass(events []midiparse.NoteEvent, outputFile string, offset, maxEnd float64) error {
 	fmt.Println("\n\n\n\nBuilding FFmpeg command...\n\n\n\n\n", events)
 	if len(events) == 0 {
 		return fmt.Errorf("no events to process")
@@ -112,96 +188,185 @@ func buildFFmpegSinglePass(events []midiparse.NoteEvent, outputFile string, maxE
 		return events[i].Start < events[j].Start
 	})
 
-	inputs := []string{}
-	filterComplex := ""
-	audioLabels := []string{}
-
-	// Add inputs and build filter chains
+	// Resolve every event to a library clip first so each distinct clip is
+	// opened (and decoded) once, then fanned out to its events with split/asplit.
+	files := make([]string, len(events))
+	uses := map[string]int{}
 	for i, e := range events {
-		noteFile := strconv.Itoa(e.Note)
-		if e.Note < 100 {
-			noteFile = "0" + noteFile
+		file, err := resolveEventClip(e)
+		if err != nil {
+			return err
 		}
-		file := fmt.Sprintf("temp_vids/%s.mp4", noteFile)
+		files[i] = file
+		uses[file]++
+	}
 
-		// Check if file exists, if not try same note in other octaves
-		if _, err := os.Stat(file); os.IsNotExist(err) {
-			file = findNoteInOtherOctave(e.Note)
-			if file == "" {
-				return fmt.Errorf("could not find video for note %s in any octave", noteFile)
-			}
-			fmt.Printf("Note %s not found, using %s instead\n", noteFile, file)
+	g := ffgraph.New()
+	videoBranches := map[string][]ffgraph.Pad{}
+	audioBranches := map[string][]ffgraph.Pad{}
+	for _, file := range files {
+		if _, ok := videoBranches[file]; ok {
+			continue
 		}
+		in := g.AddInput(file)
 
-		inputs = append(inputs, "-i", file)
-
-		// Video: trim to duration, reset timestamps to start at 0, scale, setpts to delay
-		filterComplex += fmt.Sprintf("[%d:v]trim=duration=%.3f,setpts=PTS-STARTPTS,scale=1920:1080:force_original_aspect_ratio=decrease,pad=1920:1080:(ow-iw)/2:(oh-ih)/2,setpts=PTS+%.3f/TB,format=yuv420p[v%d];",
-			i, e.Duration, e.Start, i)
+		// Crop/scale to the output frame once per clip, before fanning out
+		filters, err := layerFilters(file)
+		if err != nil {
+			return err
+		}
+		scaled := g.Apply(g.Stream(in, "v"), "s", append(filters, ffgraph.NewFilter("format").Arg("yuva420p"))...)
+		videoBranches[file] = g.Split(scaled, uses[file], "sv")
+		audioBranches[file] = g.ASplit(g.Stream(in, "a"), uses[file], "sa")
+	}
 
-		// Audio: trim, delay, volume enable. Times (e.Start) are relative to the segment start.
-		delayMS := int(e.Start * 1000)
-		filterComplex += fmt.Sprintf("[%d:a]atrim=duration=%.3f,asetpts=PTS-STARTPTS,adelay=%d|%d,volume=enable='between(t,%.3f,%.3f)':volume=1[a%d];",
-			i, e.Duration, delayMS, delayMS, e.Start, e.Start+e.Duration, i)
-		audioLabels = append(audioLabels, fmt.Sprintf("[a%d]", i))
+	spans := planTransitions(events, maxEnd)
+	videoLabels := []ffgraph.Pad{}
+	audioLabels := []ffgraph.Pad{}
+	audioTracks := []int{}
+	for i, e := range events {
+		file := files[i]
+		v, a := videoBranches[file][0], audioBranches[file][0]
+		videoBranches[file], audioBranches[file] = videoBranches[file][1:], audioBranches[file][1:]
+
+		// Video: trim to its time on screen, reset timestamps to start at 0
+		// (or at the skipped time of a held note, so effects do not restart),
+		// note effects and transition, setpts to delay
+		skip := math.Max(0, -e.Start)
+		videoFilters := []*ffgraph.Filter{
+			ffgraph.NewFilter("trim").Setf("duration", "%.3f", spans[i].show),
+			ffgraph.NewFilter("setpts").Arg("PTS-STARTPTS"),
+		}
+		if skip > 0 {
+			videoFilters = []*ffgraph.Filter{
+				ffgraph.NewFilter("trim").Setf("start", "%.3f", skip).Setf("duration", "%.3f", spans[i].show-skip),
+				ffgraph.NewFilter("setpts").Argf("PTS-STARTPTS+%.3f/TB", skip),
+			}
+		}
+		videoFilters = append(videoFilters, visualEffectFilters(e, offset)...)
+		videoFilters = append(videoFilters, transitionFilters(spans[i])...)
+		videoFilters = append(videoFilters, ffgraph.NewFilter("setpts").Argf("PTS%+.3f/TB", e.Start))
+		videoLabels = append(videoLabels, g.Apply(v, "v", videoFilters...))
+
+		// Audio: trim, pan, delay, volume enable. Times (e.Start) are relative to the segment start.
+		delayMS := int(math.Max(0, e.Start) * 1000)
+		atrim := ffgraph.NewFilter("atrim").Setf("duration", "%.3f", e.Duration)
+		if skip > 0 {
+			atrim = ffgraph.NewFilter("atrim").Setf("start", "%.3f", skip).Setf("duration", "%.3f", e.Duration-skip)
+		}
+		audioFilters := []*ffgraph.Filter{
+			atrim,
+			ffgraph.NewFilter("asetpts").Arg("PTS-STARTPTS"),
+		}
+		if pan := panFilter(e, file); pan != nil {
+			audioFilters = append(audioFilters, pan)
+		}
+		audioFilters = append(audioFilters,
+			ffgraph.NewFilter("adelay").Argf("%d|%d", delayMS, delayMS),
+			ffgraph.NewFilter("volume").Setf("enable", "between(t,%.3f,%.3f)", e.Start, e.Start+e.Duration).Setf("volume", "%.2fdB", Mix.VoiceGainDB),
+		)
+		audioLabels = append(audioLabels, g.Apply(a, "a", audioFilters...))
+		audioTracks = append(audioTracks, e.Track)
 	}
 
-	// Create a black background video for the segment duration
-	filterComplex += fmt.Sprintf("color=black:s=1920x1080:d=%.3f,format=yuv420p[bg];", maxEnd)
+	// Background scene (black unless sections are configured) for the segment duration
+	currentLabel, err := addBackground(g, offset, maxEnd)
+	if err != nil {
+		return err
+	}
 
 	// Build overlay chain starting from black background
-	currentLabel := "[bg]"
-	for i := 0; i < len(events); i++ {
-		outputLabel := ""
-		if i == len(events)-1 {
-			outputLabel = "[vout]"
+	vout := g.Named("vout")
+	for i, v := range videoLabels {
+		var outputLabel ffgraph.Pad
+		if i == len(videoLabels)-1 {
+			outputLabel = vout
 		} else {
-			outputLabel = fmt.Sprintf("[tmp%d]", i)
+			outputLabel = g.Label("tmp")
 		}
 
 		// Use shortest=0 to ensure the black background stream dictates the length
-		filterComplex += fmt.Sprintf("%s[v%d]overlay=shortest=0:eof_action=pass%s;",
-			currentLabel, i, outputLabel)
+		overlay := ffgraph.NewFilter("overlay").Set("shortest", "0").Set("eof_action", "pass")
+		if x := overlayX(events[i].Start, spans[i]); x != "" {
+			overlay.Set("x", x)
+		}
+		g.Chain([]ffgraph.Pad{currentLabel, v}, []ffgraph.Pad{outputLabel}, overlay)
 		currentLabel = outputLabel
 	}
 
 	// --- CRITICAL AUDIO FIX: Ensure an audio stream is always created ---
 	// Add a silent audio source with the same duration as the segment (maxEnd)
-	filterComplex += fmt.Sprintf("anullsrc=channel_layout=stereo:sample_rate=44100:d=%.3f[silence];", maxEnd)
+	silence := g.Source("silence",
+		ffgraph.NewFilter("anullsrc").Set("channel_layout", "stereo").Setf("sample_rate", "%d", OutputProfile.SampleRate).Setf("d", "%.3f", maxEnd))
 
-	// Start the mixer inputs with the silence stream
-	mixerInputs := []string{"[silence]"}
+	// Mix the silence stream and all generated note audio streams at constant
+	// per-voice gain, through the track and global effects chains
+	notes := mixNotes(g, silence, audioLabels, audioTracks)
+	// --- END CRITICAL AUDIO FIX ---
 
-	// Add all generated note audio streams
-	mixerInputs = append(mixerInputs, audioLabels...)
+	// Backing track under the notes for this segment's window of the song,
+	// then the master compressor/limiter
+	aout := masterBus(g, addBacking(g, notes, offset, maxEnd))
 
-	// Join the labels for the amix filter
-	allAudioInputs := strings.Join(mixerInputs, "")
+	// Note names, lyrics and piano roll over the finished scene
+	vout, overlayFiles, err := addOverlays(g, vout, events, outputFile, offset, maxEnd)
+	for _, f := range overlayFiles {
+		defer os.Remove(f)
+	}
+	if err != nil {
+		return err
+	}
 
-	// Mix all audio sources (note audio + silence)
-	audioFilter := fmt.Sprintf("%samix=inputs=%d:duration=longest[aout]",
-		allAudioInputs, len(mixerInputs))
-	filterComplex += audioFilter
-	// --- END CRITICAL AUDIO FIX ---
+	g.Output(vout)
+	g.Output(aout)
+	if err := g.Validate(); err != nil {
+		return fmt.Errorf("invalid filter graph: %w", err)
+	}
+
+	// Write the graph to a script file next to the output; with hundreds of
+	// inputs the inline -filter_complex string exceeds argv limits.
+	scriptFile := strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".filtergraph"
+	scriptArgs, err := g.WriteScript(scriptFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(scriptFile)
 
-	cmdArgs := append(inputs,
-		"-filter_complex", filterComplex,
-		"-map", "[vout]", "-map", "[aout]",
-		"-c:v", "libx264",
-		"-c:a", "aac",
-		"-pix_fmt", "yuv420p",
+	cmdArgs := append(g.InputArgs(), scriptArgs...)
+	cmdArgs = append(cmdArgs, g.MapArgs()...)
+	cmdArgs = append(cmdArgs, OutputProfile.VideoArgs()...)
+	cmdArgs = append(cmdArgs, OutputProfile.AudioArgs()...)
+	cmdArgs = append(cmdArgs,
 		"-t", fmt.Sprintf("%.3f", maxEnd), // Limit output duration to segment length
 		"-y", // Overwrite output file
 		outputFile,
 	)
 
-	fmt.Printf("Running FFmpeg command with %d inputs\n", len(events))
+	fmt.Printf("Running FFmpeg command with %d inputs for %d events\n", len(g.Inputs()), len(events))
 	fmt.Printf("Total duration: %.3f seconds\n", maxEnd)
 
-	cmd := exec.Command("ffmpeg", cmdArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	_, err = Runner.Run(context.Background(), "ffmpeg", cmdArgs...)
+	return err
+}
+
+// resolveClip returns the library clip for a note, falling back to the same
+// note in another octave when the exact clip was never recorded.
+func resolveClip(note int) (string, error) {
+	noteFile := strconv.Itoa(note)
+	if note < 100 {
+		noteFile = "0" + noteFile
+	}
+	file := fmt.Sprintf("temp_vids/%s.mp4", noteFile)
+
+	// Check if file exists, if not try same note in other octaves
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		file = findNoteInOtherOctave(note)
+		if file == "" {
+			return "", fmt.Errorf("could not find video for note %s in any octave", noteFile)
+		}
+		fmt.Printf("Note %s not found, using %s instead\n", noteFile, file)
+	}
+	return file, nil
 }
 
 // combineSegments is a function that joins video segments using the ffmpeg 'concat' demuxer.
@@ -243,14 +408,10 @@ func combineSegments(segments []string, outputFile string, duration float64) err
 		outputFile,
 	}
 
-	cmd := exec.Command("ffmpeg", cmdArgs...)
-
 	// Print the command for debugging purposes (helpful to see what ffmpeg executes)
 	fmt.Printf("Executing command: ffmpeg %s\n", strings.Join(cmdArgs, " "))
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	_, err := Runner.Run(context.Background(), "ffmpeg", cmdArgs...)
 
 	if err != nil {
 		return fmt.Errorf("ffmpeg concatenation failed: %w", err)
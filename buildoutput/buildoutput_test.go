@@ -0,0 +1,142 @@
+package buildoutput
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"hello/cmdrun"
+	"hello/midiparse"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with testdata/<name>.golden, rewriting it with -update.
+// Paths are resolved before the test changes into its clip library.
+func golden(t *testing.T, path, got string) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s:\n got:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// renderTest runs a render against a Recorder in a scratch directory holding
+// empty clips for notes, and returns the ffmpeg transcript with every filter
+// script inlined after the command that read it.
+func renderTest(t *testing.T, notes []int, events []midiparse.NoteEvent) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "temp_vids"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range notes {
+		if err := os.WriteFile(filepath.Join(dir, "temp_vids", fmt.Sprintf("%03d.mp4", n)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+
+	oldRunner, oldLoudness := Runner, Mix.LoudnessLUFS
+	t.Cleanup(func() { Runner, Mix.LoudnessLUFS = oldRunner, oldLoudness })
+	Mix.LoudnessLUFS = 0
+
+	var out strings.Builder
+	Runner = &cmdrun.Recorder{Respond: func(c cmdrun.Call) (cmdrun.Result, error) {
+		fmt.Fprintln(&out, c)
+		for i, a := range c.Args {
+			if a == "-filter_complex_script" && i+1 < len(c.Args) {
+				script, err := os.ReadFile(c.Args[i+1])
+				if err != nil {
+					return cmdrun.Result{}, err
+				}
+				out.Write(script)
+			}
+		}
+		return cmdrun.Result{}, nil
+	}}
+
+	if err := BuildFFmpegCommandWithAudio(events, "out.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestSinglePassCommand(t *testing.T) {
+	want, _ := filepath.Abs("testdata/single_pass.golden")
+	got := renderTest(t, []int{60, 64}, []midiparse.NoteEvent{
+		{Note: 60, Start: 0, Duration: 1, Velocity: 100},
+		{Note: 64, Start: 0.5, Duration: 1, Velocity: 80},
+		{Note: 60, Start: 1.5, Duration: 0.5, Velocity: 100},
+	})
+	golden(t, want, got)
+}
+
+func TestBatchedCommand(t *testing.T) {
+	want, _ := filepath.Abs("testdata/batched.golden")
+	old := MaxEventsPerBatch
+	t.Cleanup(func() { MaxEventsPerBatch = old })
+	MaxEventsPerBatch = 2
+
+	got := renderTest(t, []int{60, 62, 64}, []midiparse.NoteEvent{
+		{Note: 60, Start: 0, Duration: 0.5, Velocity: 100},
+		{Note: 62, Start: 0.5, Duration: 0.5, Velocity: 100},
+		{Note: 64, Start: 1, Duration: 0.5, Velocity: 100},
+		{Note: 60, Start: 1.5, Duration: 0.5, Velocity: 100},
+		{Note: 62, Start: 2, Duration: 0.5, Velocity: 100},
+	})
+	golden(t, want, got)
+}
+
+// A chord straddling the batch size must not be split across segments: the
+// notes of segment 0 starting with segment 1 used to be dropped.
+func TestBatchedChordStaysTogether(t *testing.T) {
+	want, _ := filepath.Abs("testdata/batched_chord.golden")
+	old := MaxEventsPerBatch
+	t.Cleanup(func() { MaxEventsPerBatch = old })
+	MaxEventsPerBatch = 2
+
+	events := []midiparse.NoteEvent{
+		{Note: 60, Start: 0, Duration: 1, Velocity: 100},
+		{Note: 64, Start: 1, Duration: 1, Velocity: 100},
+		{Note: 67, Start: 1, Duration: 1, Velocity: 100},
+		{Note: 60, Start: 2, Duration: 1, Velocity: 100},
+	}
+	if got := batchBounds(events, 2); fmt.Sprint(got) != "[[0 1] [1 3] [3 4]]" {
+		t.Errorf("batchBounds = %v", got)
+	}
+	got := renderTest(t, []int{60, 64, 67}, events)
+	if n := strings.Count(got, "between(t\\,1.000"); n != 0 {
+		t.Errorf("chord note rendered in segment 0")
+	}
+	golden(t, want, got)
+}
+
+// Notes held across a segment boundary continue in the next segment from
+// where their clip was cut instead of stopping at the boundary.
+func TestBatchedHeldNoteCarries(t *testing.T) {
+	want, _ := filepath.Abs("testdata/batched_held.golden")
+	old := MaxEventsPerBatch
+	t.Cleanup(func() { MaxEventsPerBatch = old })
+	MaxEventsPerBatch = 1
+
+	got := renderTest(t, []int{60, 64}, []midiparse.NoteEvent{
+		{Note: 60, Start: 0, Duration: 2, Velocity: 100},
+		{Note: 64, Start: 1.5, Duration: 1, Velocity: 100},
+	})
+	if !strings.Contains(got, "atrim=start=1.500:duration=0.500") {
+		t.Errorf("held note not carried into segment 1:\n%s", got)
+	}
+	golden(t, want, got)
+}
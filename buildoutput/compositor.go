@@ -0,0 +1,397 @@
+package buildoutput
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"hello/cmdrun"
+	"hello/ffgraph"
+	"hello/midiparse"
+)
+
+// Backend selects how the timeline is rendered.
+type Backend string
+
+const (
+	// BackendFFmpeg builds one overlay filter graph per batch (the default).
+	BackendFFmpeg Backend = "ffmpeg"
+	// BackendCompositor streams clip frames from ffmpeg decoders, composites
+	// frames and mixes audio in Go, and pipes the result into a single ffmpeg encoder.
+	BackendCompositor Backend = "compositor"
+)
+
+// RenderBackend is the backend used by BuildFFmpegCommandWithAudio.
+var RenderBackend = BackendFFmpeg
+
+const compositeChannels = 2
+
+// decodedClip is a library clip's audio decoded to interleaved 16-bit stereo
+// PCM at the output sample rate. Video is streamed per event by clipStream.
+type decodedClip struct {
+	samples []int16
+}
+
+// renderComposited renders the whole timeline in one pass. Unlike the filter
+// graph backend it needs no batching. Memory holds the PCM of every distinct
+// clip (about 10 MB per minute of clip audio) and one RGBA frame per layer on
+// screen at once; clip video is decoded by one ffmpeg stream per visible layer.
+func renderComposited(events []midiparse.NoteEvent, outputFile string, maxEnd float64) error {
+	ctx := context.Background()
+
+	files := make([]string, len(events))
+	clips := map[string]*decodedClip{}
+	for i, e := range events {
+		file, err := resolveEventClip(e)
+		if err != nil {
+			return err
+		}
+		files[i] = file
+		if _, ok := clips[file]; ok {
+			continue
+		}
+
+		fmt.Printf("Decoding %s\n", file)
+		clip, err := decodeClip(ctx, file)
+		if err != nil {
+			return err
+		}
+		clips[file] = clip
+	}
+
+	backgrounds, err := decodeBackgrounds(ctx, maxEnd)
+	if err != nil {
+		return err
+	}
+
+	// Mix the audio up front; it is small compared to the video and lets the
+	// encoder read it from a file while video streams through stdin.
+	pcmFile := strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".pcm"
+	mix, err := mixAudio(ctx, events, files, clips, maxEnd)
+	if err != nil {
+		return err
+	}
+	if Backing != nil {
+		fmt.Printf("Decoding backing track %s\n", Backing.Path)
+		backing, err := decodeBacking(ctx)
+		if err != nil {
+			return err
+		}
+		mixBacking(mix, backing)
+	}
+	limitPCM(mix)
+	if err := writePCM(pcmFile, mix); err != nil {
+		return err
+	}
+	defer os.Remove(pcmFile)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeFrames(ctx, pw, events, files, backgrounds, newRollStrip(maxEnd), maxEnd))
+	}()
+
+	cmdArgs := []string{
+		"-f", "rawvideo",
+		"-pix_fmt", "rgba",
+		"-s", OutputProfile.Size(),
+		"-r", fmt.Sprintf("%d", OutputProfile.FPS),
+		"-i", "-",
+		"-f", "s16le",
+		"-ar", fmt.Sprintf("%d", OutputProfile.SampleRate),
+		"-ac", fmt.Sprintf("%d", compositeChannels),
+		"-i", pcmFile,
+		"-map", "0:v", "-map", "1:a",
+	}
+	if text := textOverlayFilters(events, 0, maxEnd); len(text) > 0 {
+		cmdArgs = append(cmdArgs, "-vf", filterChain(text))
+	}
+	cmdArgs = append(cmdArgs, OutputProfile.VideoArgs()...)
+	cmdArgs = append(cmdArgs, OutputProfile.AudioArgs()...)
+	cmdArgs = append(cmdArgs,
+		"-t", fmt.Sprintf("%.3f", maxEnd),
+		"-y",
+		outputFile,
+	)
+
+	fmt.Printf("Compositing %d events from %d clips (%.3f seconds)\n", len(events), len(clips), maxEnd)
+
+	_, err = Runner.RunInput(ctx, pr, "ffmpeg", cmdArgs...)
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("ffmpeg encode failed: %w", err)
+	}
+	return nil
+}
+
+// decodeClip decodes a clip's audio to PCM.
+func decodeClip(ctx context.Context, file string) (*decodedClip, error) {
+	audio, err := cmdrun.Silenced(Runner).Run(ctx,
+		"ffmpeg",
+		"-v", "error",
+		"-i", file,
+		"-vn",
+		"-f", "s16le",
+		"-ar", fmt.Sprintf("%d", OutputProfile.SampleRate),
+		"-ac", fmt.Sprintf("%d", compositeChannels),
+		"-",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("decoding audio of %s failed: %w, output: %s", file, err, string(audio.Stderr))
+	}
+
+	clip := &decodedClip{samples: make([]int16, len(audio.Stdout)/2)}
+	for i := range clip.samples {
+		clip.samples[i] = int16(binary.LittleEndian.Uint16(audio.Stdout[2*i:]))
+	}
+	return clip, nil
+}
+
+// clipStream reads one event's clip as scaled raw RGBA frames from an ffmpeg
+// decoder, one frame at a time, so only the current frame is held.
+type clipStream struct {
+	r      *io.PipeReader
+	cancel context.CancelFunc
+	frame  []byte
+	next   int // index of the next frame in the pipe
+}
+
+// openClipStream starts decoding file at the output size and frame rate.
+func openClipStream(ctx context.Context, file string) (*clipStream, error) {
+	p := OutputProfile
+	filters, err := layerFilters(file)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, ffgraph.NewFilter("fps").Argf("%d", p.FPS))
+
+	return openFrameStream(ctx, file,
+		"-v", "error",
+		"-i", file,
+		"-vf", filterChain(filters),
+		"-pix_fmt", "rgba",
+		"-f", "rawvideo",
+		"-",
+	), nil
+}
+
+// openFrameStream runs an ffmpeg decoder writing output-sized RGBA frames to
+// stdout and returns the stream reading them.
+func openFrameStream(ctx context.Context, file string, args ...string) *clipStream {
+	p := OutputProfile
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	go func() {
+		res, err := cmdrun.Silenced(Runner).RunOutput(ctx, pw, "ffmpeg", args...)
+		if err != nil && ctx.Err() == nil {
+			err = fmt.Errorf("decoding video of %s failed: %w, output: %s", file, err, string(res.Stderr))
+		}
+		pw.CloseWithError(err)
+	}()
+	return &clipStream{r: pr, cancel: cancel, frame: make([]byte, p.Width*p.Height*4)}
+}
+
+// frameAt returns frame idx, reading forward from the pipe; idx never goes
+// backwards during a render. It returns nil once the clip has run out.
+func (s *clipStream) frameAt(idx int) ([]byte, error) {
+	for s.next <= idx {
+		if _, err := io.ReadFull(s.r, s.frame); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		s.next++
+	}
+	return s.frame, nil
+}
+
+// close stops the decoder, which may still be running if the event ended
+// before its clip did.
+func (s *clipStream) close() {
+	s.cancel()
+	s.r.Close()
+}
+
+// mixAudio sums every event's clip audio at its start time, trimmed to the
+// event duration and at the fixed voice gain, into an interleaved stereo
+// buffer covering the timeline. Tracks with an effects chain are summed into
+// their own bus and processed before joining the mix; the global chain runs last.
+func mixAudio(ctx context.Context, events []midiparse.NoteEvent, files []string, clips map[string]*decodedClip, maxEnd float64) ([]float32, error) {
+	sampleRate := float64(OutputProfile.SampleRate)
+	voiceGain := float32(dbToLinear(Mix.VoiceGainDB))
+	size := int(math.Ceil(maxEnd*sampleRate)) * compositeChannels
+	mix := make([]float32, size)
+	buses := map[int][]float32{}
+
+	for i, e := range events {
+		dst := mix
+		if Effects.trackChain(e.Track) != nil {
+			if buses[e.Track] == nil {
+				buses[e.Track] = make([]float32, size)
+			}
+			dst = buses[e.Track]
+		}
+
+		samples := clips[files[i]].samples
+		offset := int(e.Start*sampleRate) * compositeChannels
+		n := int(e.Duration*sampleRate) * compositeChannels
+		if n > len(samples) {
+			n = len(samples)
+		}
+		// A note starting before 0 is heard from 0, partway into its clip
+		skip := 0
+		if offset < 0 {
+			skip, offset = -offset, 0
+		}
+		l, r := noteGains(e, files[i])
+		gains := [compositeChannels]float32{voiceGain * float32(l), voiceGain * float32(r)}
+		for j := skip; j < n && offset+j-skip < len(dst); j++ {
+			dst[offset+j-skip] += float32(samples[j]) * gains[j%compositeChannels]
+		}
+	}
+
+	tracks := make([]int, 0, len(buses))
+	for track := range buses {
+		tracks = append(tracks, track)
+	}
+	sort.Ints(tracks)
+	for _, track := range tracks {
+		fmt.Printf("Applying effects to track %d\n", track)
+		processed, err := processPCM(ctx, buses[track], Effects.trackChain(track))
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %w", track, err)
+		}
+		for j, v := range processed {
+			mix[j] += v
+		}
+	}
+
+	return processPCM(ctx, mix, Effects.Global)
+}
+
+// writePCM clamps the mix to 16 bits and writes it as raw little-endian PCM.
+func writePCM(path string, mix []float32) error {
+	buf := make([]byte, len(mix)*2)
+	for i, s := range mix {
+		if s > math.MaxInt16 {
+			s = math.MaxInt16
+		} else if s < math.MinInt16 {
+			s = math.MinInt16
+		}
+		binary.LittleEndian.PutUint16(buf[2*i:], uint16(int16(s)))
+	}
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		return fmt.Errorf("failed to write mixed audio: %w", err)
+	}
+	return nil
+}
+
+// writeFrames composites every output frame and writes it to w. Layers are
+// drawn in event order over the background, like the overlay chain in the filter graph
+// backend, and a layer disappears once its clip runs out (eof_action=pass).
+// Events are sorted by start, so only the window of layers on screen is
+// visited per frame and each has its own decoder stream.
+func writeFrames(ctx context.Context, w io.Writer, events []midiparse.NoteEvent, files []string, backgrounds *backgroundLayers, roll *rollStrip, maxEnd float64) error {
+	fps := float64(OutputProfile.FPS)
+	frame := make([]byte, OutputProfile.Width*OutputProfile.Height*4)
+	fx, scratch, tr := make([]byte, len(frame)), make([]byte, len(frame)), make([]byte, len(frame))
+	spans := planTransitions(events, maxEnd)
+	total := int(math.Ceil(maxEnd * fps))
+
+	streams := map[int]*clipStream{} // by event index
+	defer func() {
+		for _, s := range streams {
+			s.close()
+		}
+		backgrounds.close()
+	}()
+	var active []int // event indices on screen, in event order
+	next := 0
+
+	for f := 0; f < total; f++ {
+		t := float64(f) / fps
+		if err := backgrounds.draw(ctx, frame, t); err != nil {
+			return err
+		}
+
+		for ; next < len(events) && events[next].Start <= t; next++ {
+			active = append(active, next)
+		}
+		kept := active[:0]
+		for _, i := range active {
+			e := events[i]
+			if t >= e.Start+spans[i].show {
+				if s, ok := streams[i]; ok {
+					s.close()
+					delete(streams, i)
+				}
+				continue
+			}
+			kept = append(kept, i)
+
+			s, ok := streams[i]
+			if !ok {
+				var err error
+				if s, err = openClipStream(ctx, files[i]); err != nil {
+					return err
+				}
+				streams[i] = s
+			}
+			layer, err := s.frameAt(frameIndex(t-e.Start, fps))
+			if err != nil {
+				return err
+			}
+			if layer == nil {
+				continue
+			}
+			layerFrame := applyVisualEffects(fx, scratch, layer, e, t-e.Start)
+			if spans[i].in > 0 {
+				layerFrame = applyTransition(tr, layerFrame, (t-e.Start)/spans[i].in)
+			}
+			blendOver(frame, layerFrame)
+		}
+		active = kept
+		roll.draw(frame, t)
+
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// frameIndex is the frame of a stream showing t seconds after it starts. The
+// epsilon keeps float error in t from truncating to the frame before.
+func frameIndex(t, fps float64) int {
+	return int(t*fps + 1e-6)
+}
+
+// clearFrame fills an RGBA frame with opaque black.
+func clearFrame(frame []byte) {
+	for i := 0; i < len(frame); i += 4 {
+		frame[i], frame[i+1], frame[i+2], frame[i+3] = 0, 0, 0, 255
+	}
+}
+
+// blendOver draws src over dst using src alpha.
+func blendOver(dst, src []byte) {
+	for i := 0; i < len(dst); i += 4 {
+		a := uint32(src[i+3])
+		switch a {
+		case 255:
+			copy(dst[i:i+4], src[i:i+4])
+		case 0:
+		default:
+			for c := 0; c < 3; c++ {
+				dst[i+c] = byte((uint32(src[i+c])*a + uint32(dst[i+c])*(255-a)) / 255)
+			}
+			dst[i+3] = 255
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package buildoutput
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"hello/cmdrun"
+	"hello/midiparse"
+)
+
+// TestWriteFramesStreamsLayers checks that each visible event is decoded by
+// its own stream, drawn only while on screen, and dropped when its clip ends.
+func TestWriteFramesStreamsLayers(t *testing.T) {
+	oldRunner, oldProfile := Runner, OutputProfile
+	t.Cleanup(func() { Runner, OutputProfile = oldRunner, oldProfile })
+	OutputProfile.Width, OutputProfile.Height, OutputProfile.FPS = 2, 1, 10
+
+	// Every clip decodes to three solid frames of a colour picked by file name
+	colors := map[string]byte{"red.mp4": 200, "green.mp4": 100}
+	rec := &cmdrun.Recorder{Respond: func(c cmdrun.Call) (cmdrun.Result, error) {
+		var file string
+		for i, a := range c.Args {
+			if a == "-i" {
+				file = c.Args[i+1]
+			}
+		}
+		px := []byte{colors[file], 0, 0, 255}
+		return cmdrun.Result{Stdout: bytes.Repeat(px, 2*3)}, nil
+	}}
+	Runner = rec
+
+	events := []midiparse.NoteEvent{
+		{Note: 60, Start: 0, Duration: 0.2},
+		{Note: 62, Start: 0.1, Duration: 0.5},
+	}
+	files := []string{"red.mp4", "green.mp4"}
+
+	var out bytes.Buffer
+	if err := writeFrames(context.Background(), &out, events, files, &backgroundLayers{}, nil, 0.6); err != nil {
+		t.Fatal(err)
+	}
+
+	// Red shows at 0.0, green covers it from 0.1 until its three frames run out
+	want := []byte{200, 100, 100, 100, 0, 0}
+	frames := out.Bytes()
+	if len(frames) != len(want)*8 {
+		t.Fatalf("wrote %d bytes, want %d frames", len(frames), len(want))
+	}
+	for f, r := range want {
+		if got := frames[f*8]; got != r {
+			t.Errorf("frame %d red = %d, want %d", f, got, r)
+		}
+	}
+	if n := strings.Count(rec.Transcript(), "rawvideo"); n != 2 {
+		t.Errorf("opened %d decoder streams, want one per event:\n%s", n, rec.Transcript())
+	}
+}
+
+// TestMixAudioNegativeStart checks that a note starting before 0 is mixed
+// from 0 with the part of its clip still sounding, instead of panicking.
+func TestMixAudioNegativeStart(t *testing.T) {
+	oldProfile, oldMix, oldEffects, oldPan := OutputProfile, Mix, Effects, Pan
+	t.Cleanup(func() { OutputProfile, Mix, Effects, Pan = oldProfile, oldMix, oldEffects, oldPan })
+	OutputProfile.SampleRate = 10
+	Mix.VoiceGainDB = 0
+	Effects = EffectsConfig{}
+	Pan = PanCenter
+
+	events := []midiparse.NoteEvent{{Note: 60, Start: -0.2, Duration: 0.4}}
+	files := []string{"a.mp4"}
+	clips := map[string]*decodedClip{"a.mp4": {samples: []int16{1, 1, 2, 2, 3, 3, 4, 4}}}
+
+	mix, err := mixAudio(context.Background(), events, files, clips, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float32{3, 3, 4, 4, 0, 0}
+	if len(mix) != len(want) {
+		t.Fatalf("mixed %d samples, want %d", len(mix), len(want))
+	}
+	for i, w := range want {
+		if mix[i] != w {
+			t.Errorf("sample %d = %g, want %g", i, mix[i], w)
+		}
+	}
+}
+
+func TestFrameIndex(t *testing.T) {
+	tests := []struct {
+		t, fps float64
+		want   int
+	}{
+		{0, 30, 0},
+		{0.09999999999999998, 10, 1}, // 0.3 - 0.2 at run time
+		{0.149, 10, 1},
+		{1.0 / 30 * 29, 30, 29},
+	}
+	for _, tt := range tests {
+		if got := frameIndex(tt.t, tt.fps); got != tt.want {
+			t.Errorf("frameIndex(%v, %v) = %d, want %d", tt.t, tt.fps, got, tt.want)
+		}
+	}
+}
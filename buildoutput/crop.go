@@ -0,0 +1,263 @@
+package buildoutput
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"hello/cmdrun"
+	"hello/ffgraph"
+)
+
+// CropMode decides how a library clip is fitted to the output aspect ratio.
+type CropMode string
+
+const (
+	// CropFit scales the whole clip down and letterboxes it (the original behaviour).
+	CropFit CropMode = "fit"
+	// CropCenter fills the frame and crops the overflow equally on both sides.
+	CropCenter CropMode = "center"
+	// CropManual uses a per-clip box from ManualCrops, then fills the frame.
+	CropManual CropMode = "manual"
+	// CropAuto finds the region of motion with cropdetect and centres the
+	// output crop on it, so the performer stays in frame.
+	CropAuto CropMode = "auto"
+)
+
+// CropBox is a source rectangle in pixels.
+type CropBox struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// Crop is the crop mode applied to every note layer.
+var Crop = CropFit
+
+// ManualCrops maps a library clip path (e.g. temp_vids/060.mp4) to its crop
+// box for CropManual. Clips without an entry fall back to a centre crop.
+var ManualCrops = map[string]CropBox{}
+
+// motionRegion is what cropdetect found in a clip, in source pixels.
+type motionRegion struct {
+	motion     CropBox
+	srcW, srcH int
+}
+
+// motionRegions caches detections, one per clip per run.
+var motionRegions = map[string]motionRegion{}
+
+// LoadCropBoxes reads a JSON object of clip path to {"x","y","w","h"} into
+// ManualCrops. Each box must lie inside its clip's frame, which is probed.
+func LoadCropBoxes(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read crop boxes: %w", err)
+	}
+	boxes := map[string]CropBox{}
+	if err := json.Unmarshal(data, &boxes); err != nil {
+		return fmt.Errorf("failed to parse crop boxes %s: %w", path, err)
+	}
+	for file, box := range boxes {
+		if box.W <= 0 || box.H <= 0 || box.X < 0 || box.Y < 0 {
+			return fmt.Errorf("invalid crop box for %s: %+v", file, box)
+		}
+		srcW, srcH, err := probeSize(file)
+		if err != nil {
+			return fmt.Errorf("crop box for %s: %w", file, err)
+		}
+		if box.X+box.W > srcW || box.Y+box.H > srcH {
+			return fmt.Errorf("crop box for %s %+v is outside the %dx%d frame", file, box, srcW, srcH)
+		}
+	}
+	ManualCrops = boxes
+	return nil
+}
+
+// layerFilters returns the filters that turn a library clip into a full-frame
+// layer at the output resolution, according to Crop.
+func layerFilters(file string) ([]*ffgraph.Filter, error) {
+	w, h := OutputProfile.Width, OutputProfile.Height
+
+	fill := []*ffgraph.Filter{
+		ffgraph.NewFilter("scale").Argf("%d", w).Argf("%d", h).Set("force_original_aspect_ratio", "increase"),
+		ffgraph.NewFilter("crop").Argf("%d", w).Argf("%d", h),
+		ffgraph.NewFilter("setsar").Arg("1"),
+	}
+
+	switch Crop {
+	case CropFit, "":
+		return []*ffgraph.Filter{
+			ffgraph.NewFilter("scale").Argf("%d", w).Argf("%d", h).Set("force_original_aspect_ratio", "decrease"),
+			// Transparent bars so the background shows around the clip
+			ffgraph.NewFilter("format").Arg("yuva420p"),
+			ffgraph.NewFilter("pad").Argf("%d", w).Argf("%d", h).Arg("(ow-iw)/2").Arg("(oh-ih)/2").Set("color", "black@0"),
+			ffgraph.NewFilter("setsar").Arg("1"),
+		}, nil
+
+	case CropCenter:
+		return fill, nil
+
+	case CropManual:
+		box, ok := ManualCrops[file]
+		if !ok {
+			fmt.Printf("No crop box for %s, using centre crop\n", file)
+			return fill, nil
+		}
+		return append([]*ffgraph.Filter{cropFilter(box)}, fill...), nil
+
+	case CropAuto:
+		box, err := detectMotionCrop(file)
+		if err != nil {
+			fmt.Printf("Motion crop failed for %s, using centre crop: %v\n", file, err)
+			return fill, nil
+		}
+		return append([]*ffgraph.Filter{cropFilter(box)}, fill...), nil
+	}
+
+	return nil, fmt.Errorf("unknown crop mode %q", Crop)
+}
+
+// filterChain renders filters as a -vf value.
+func filterChain(filters []*ffgraph.Filter) string {
+	parts := make([]string, len(filters))
+	for i, f := range filters {
+		parts[i] = f.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func cropFilter(box CropBox) *ffgraph.Filter {
+	return ffgraph.NewFilter("crop").Argf("%d", box.W).Argf("%d", box.H).Argf("%d", box.X).Argf("%d", box.Y)
+}
+
+var cropdetectLine = regexp.MustCompile(`crop=(\d+):(\d+):(\d+):(\d+)`)
+
+// detectMotionCrop returns a box with the output aspect ratio centred on the
+// moving region of the clip.
+func detectMotionCrop(file string) (CropBox, error) {
+	region, err := detectMotion(file)
+	if err != nil {
+		return CropBox{}, err
+	}
+	box := aspectCrop(region.motion, region.srcW, region.srcH, float64(OutputProfile.Width)/float64(OutputProfile.Height))
+	fmt.Printf("Motion crop for %s: %+v (motion %+v)\n", file, box, region.motion)
+	return box, nil
+}
+
+// detectMotion runs cropdetect in motion-vector mode over the clip.
+func detectMotion(file string) (motionRegion, error) {
+	if region, ok := motionRegions[file]; ok {
+		return region, nil
+	}
+
+	srcW, srcH, err := probeSize(file)
+	if err != nil {
+		return motionRegion{}, err
+	}
+
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(),
+		"ffmpeg",
+		"-flags2", "+export_mvs",
+		"-i", file,
+		"-vf", "cropdetect=mode=mvedges",
+		"-f", "null",
+		"-",
+	)
+	if err != nil {
+		return motionRegion{}, fmt.Errorf("ffmpeg cropdetect failed: %w", err)
+	}
+
+	// cropdetect never resets by default, so the last report is the bounding
+	// box of all motion in the clip.
+	matches := cropdetectLine.FindAllStringSubmatch(string(res.Combined()), -1)
+	if len(matches) == 0 {
+		return motionRegion{}, fmt.Errorf("cropdetect reported no motion")
+	}
+	last := matches[len(matches)-1]
+	motion := CropBox{}
+	motion.W, _ = strconv.Atoi(last[1])
+	motion.H, _ = strconv.Atoi(last[2])
+	motion.X, _ = strconv.Atoi(last[3])
+	motion.Y, _ = strconv.Atoi(last[4])
+
+	region := motionRegion{motion: motion, srcW: srcW, srcH: srcH}
+	motionRegions[file] = region
+	return region, nil
+}
+
+// probeSize returns the frame size of the clip's first video stream.
+func probeSize(file string) (int, int, error) {
+	probe, err := cmdrun.Silenced(Runner).Run(context.Background(),
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "csv=p=0",
+		file,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	return parseProbeSize(string(probe.Stdout))
+}
+
+func parseProbeSize(out string) (int, int, error) {
+	fields := strings.Split(strings.TrimSpace(out), ",")
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("could not parse ffprobe size %q", out)
+	}
+	w, err1 := strconv.Atoi(strings.TrimSpace(fields[0]))
+	h, err2 := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err1 != nil || err2 != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("could not parse ffprobe size %q", out)
+	}
+	return w, h, nil
+}
+
+// aspectCrop grows the motion box to the target aspect ratio around its
+// centre, shrinking only if the source is too small, and keeps it inside the
+// source frame. Sizes are kept even for yuv420p. An empty motion box (no
+// motion found) falls back to the full frame.
+func aspectCrop(motion CropBox, srcW, srcH int, aspect float64) CropBox {
+	if motion.W <= 0 || motion.H <= 0 {
+		motion = CropBox{W: srcW, H: srcH}
+	}
+	w := float64(motion.W)
+	h := float64(motion.H)
+	if w/h < aspect {
+		w = h * aspect
+	} else {
+		h = w / aspect
+	}
+	if w > float64(srcW) {
+		w = float64(srcW)
+		h = w / aspect
+	}
+	if h > float64(srcH) {
+		h = float64(srcH)
+		w = h * aspect
+	}
+
+	cx := float64(motion.X) + float64(motion.W)/2
+	cy := float64(motion.Y) + float64(motion.H)/2
+	box := CropBox{W: int(w) &^ 1, H: int(h) &^ 1}
+	box.X = clampInt(int(cx-w/2), 0, srcW-box.W)
+	box.Y = clampInt(int(cy-h/2), 0, srcH-box.H)
+	return box
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,67 @@
+package buildoutput
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"hello/cmdrun"
+)
+
+func TestAspectCrop(t *testing.T) {
+	tests := []struct {
+		name   string
+		motion CropBox
+		want   CropBox
+	}{
+		{"grows to aspect", CropBox{X: 800, Y: 400, W: 160, H: 180}, CropBox{X: 720, Y: 400, W: 320, H: 180}},
+		{"clamped to frame", CropBox{X: 0, Y: 0, W: 100, H: 1080}, CropBox{X: 0, Y: 0, W: 1920, H: 1080}},
+		{"no motion", CropBox{}, CropBox{X: 0, Y: 0, W: 1920, H: 1080}},
+		{"zero height", CropBox{X: 10, Y: 10, W: 500, H: 0}, CropBox{X: 0, Y: 0, W: 1920, H: 1080}},
+	}
+	for _, tt := range tests {
+		if got := aspectCrop(tt.motion, 1920, 1080, 16.0/9); got != tt.want {
+			t.Errorf("%s: aspectCrop(%+v) = %+v, want %+v", tt.name, tt.motion, got, tt.want)
+		}
+	}
+}
+
+func TestLoadCropBoxes(t *testing.T) {
+	oldRunner, oldCrops := Runner, ManualCrops
+	t.Cleanup(func() { Runner, ManualCrops = oldRunner, oldCrops })
+	Runner = &cmdrun.Recorder{Respond: func(c cmdrun.Call) (cmdrun.Result, error) {
+		if c.Args[len(c.Args)-1] == "missing.mp4" {
+			return cmdrun.Result{}, errors.New("exit status 1")
+		}
+		return cmdrun.Result{Stdout: []byte("1280,720\n")}, nil
+	}}
+
+	tests := []struct {
+		name, json string
+		ok         bool
+	}{
+		{"inside", `{"a.mp4": {"x": 100, "y": 0, "w": 1180, "h": 720}}`, true},
+		{"too wide", `{"a.mp4": {"x": 101, "y": 0, "w": 1180, "h": 720}}`, false},
+		{"too tall", `{"a.mp4": {"x": 0, "y": 10, "w": 640, "h": 720}}`, false},
+		{"negative", `{"a.mp4": {"x": -1, "y": 0, "w": 640, "h": 360}}`, false},
+		{"probe fails", `{"missing.mp4": {"x": 0, "y": 0, "w": 640, "h": 360}}`, false},
+	}
+	for _, tt := range tests {
+		ManualCrops = map[string]CropBox{}
+		path := filepath.Join(t.TempDir(), "boxes.json")
+		if err := os.WriteFile(path, []byte(tt.json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err := LoadCropBoxes(path)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: LoadCropBoxes error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if tt.ok && ManualCrops["a.mp4"] != (CropBox{X: 100, W: 1180, H: 720}) {
+			t.Errorf("%s: ManualCrops = %v", tt.name, ManualCrops)
+		}
+		if !tt.ok && len(ManualCrops) != 0 {
+			t.Errorf("%s: rejected boxes were kept: %v", tt.name, ManualCrops)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package buildoutput
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"hello/midiparse"
+)
+
+// DrumKit maps General MIDI percussion keys on channel 10 to named,
+// non-pitched hit clips (claps, mouth pops, table hits) in Dir, as
+// <name>.mp4. Keys without their own clip fall back to a related sound.
+type DrumKit struct {
+	Dir   string
+	Names map[int]string // GM key -> clip name
+	Hold  float64        // minimum seconds a hit stays on screen; drum notes are often a few ms
+}
+
+// Drums is the drum kit for the render; nil plays channel 10 as pitched notes.
+var Drums *DrumKit
+
+// gmDrumNames are the default clip names of the General MIDI drum keys.
+var gmDrumNames = map[int]string{
+	35: "kick", 36: "kick",
+	37: "rim", 38: "snare", 39: "clap", 40: "snare",
+	41: "tom", 43: "tom", 45: "tom", 47: "tom", 48: "tom", 50: "tom",
+	42: "hihat", 44: "hihat", 46: "openhat",
+	49: "crash", 52: "crash", 55: "crash", 57: "crash",
+	51: "ride", 53: "ride", 59: "ride",
+	54: "tambourine", 56: "cowbell",
+}
+
+// drumFallbacks is the sound tried next when a kit has no clip for a name.
+var drumFallbacks = map[string]string{
+	"openhat":    "hihat",
+	"tambourine": "hihat",
+	"ride":       "hihat",
+	"crash":      "ride",
+	"cowbell":    "rim",
+	"rim":        "snare",
+	"clap":       "snare",
+	"tom":        "kick",
+}
+
+// NewDrumKit returns the General MIDI kit for clips in dir.
+func NewDrumKit(dir string) *DrumKit {
+	names := map[int]string{}
+	for key, name := range gmDrumNames {
+		names[key] = name
+	}
+	return &DrumKit{Dir: dir, Names: names, Hold: 0.3}
+}
+
+// LoadDrumKit reads a JSON kit, {"dir": ..., "hold": ..., "clips": {"36": "mouth_pop"}},
+// whose clips override the General MIDI names.
+func LoadDrumKit(path string) (*DrumKit, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read drum kit: %w", err)
+	}
+	var cfg struct {
+		Dir   string            `json:"dir"`
+		Hold  float64           `json:"hold"`
+		Clips map[string]string `json:"clips"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse drum kit %s: %w", path, err)
+	}
+
+	if cfg.Dir == "" {
+		cfg.Dir = "temp_drums"
+	}
+	kit := NewDrumKit(cfg.Dir)
+	if cfg.Hold > 0 {
+		kit.Hold = cfg.Hold
+	}
+	for key, name := range cfg.Clips {
+		k, err := strconv.Atoi(key)
+		if err != nil || k < 0 || k > 127 {
+			return nil, fmt.Errorf("drum kit: %q is not a MIDI key", key)
+		}
+		kit.Names[k] = name
+	}
+	return kit, nil
+}
+
+// clip returns the hit clip for a drum key, following the fallbacks.
+func (k *DrumKit) clip(key int) (string, error) {
+	name, ok := k.Names[key]
+	if !ok {
+		return "", fmt.Errorf("no drum sound for key %d", key)
+	}
+	for tried := map[string]bool{}; name != "" && !tried[name]; name = drumFallbacks[name] {
+		tried[name] = true
+		file := filepath.Join(k.Dir, name+".mp4")
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("no clip for drum key %d (%s) in %s", key, k.Names[key], k.Dir)
+}
+
+// fromKit reports whether an event is played from the drum kit. Without a
+// kit, drum channel events play pitched clips but are still not pitches (see
+// midiparse.NoteEvent.IsDrum).
+func fromKit(e midiparse.NoteEvent) bool {
+	return Drums != nil && e.IsDrum()
+}
+
+// resolveEventClip returns the clip for an event: a drum hit on channel 10
+// when a kit is set, otherwise the pitched library clip.
+func resolveEventClip(e midiparse.NoteEvent) (string, error) {
+	if fromKit(e) {
+		return Drums.clip(e.Note)
+	}
+	return resolveClip(e.Note)
+}
+
+// holdDrums lengthens drum hits to the kit's hold time so they are seen.
+func holdDrums(events []midiparse.NoteEvent) {
+	for i, e := range events {
+		if fromKit(e) && e.Duration < Drums.Hold {
+			events[i].Duration = Drums.Hold
+		}
+	}
+}
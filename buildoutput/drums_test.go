@@ -0,0 +1,84 @@
+package buildoutput
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDrumKitClipFallbacks(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"kick", "snare", "hihat"} {
+		if err := os.WriteFile(filepath.Join(dir, name+".mp4"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kit := NewDrumKit(dir)
+
+	tests := []struct {
+		key  int
+		want string // clip name, empty for an error
+	}{
+		{36, "kick"},
+		{38, "snare"},
+		{46, "hihat"}, // openhat -> hihat
+		{49, "hihat"}, // crash -> ride -> hihat
+		{56, "snare"}, // cowbell -> rim -> snare
+		{45, "kick"},  // tom -> kick
+		{60, ""},      // not a GM drum key
+	}
+	for _, tt := range tests {
+		got, err := kit.clip(tt.key)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("clip(%d) = %s, want an error", tt.key, got)
+			}
+			continue
+		}
+		if want := filepath.Join(dir, tt.want+".mp4"); err != nil || got != want {
+			t.Errorf("clip(%d) = %q, %v, want %q", tt.key, got, err, want)
+		}
+	}
+
+	// Nothing along the fallback chain is recorded
+	if _, err := NewDrumKit(t.TempDir()).clip(49); err == nil {
+		t.Errorf("clip(49) in an empty kit did not fail")
+	}
+}
+
+func TestLoadDrumKit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kit.json")
+	if err := os.WriteFile(path, []byte(`{"dir": "hits", "hold": 0.5, "clips": {"36": "mouth_pop", "60": "clap"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	kit, err := LoadDrumKit(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kit.Dir != "hits" || kit.Hold != 0.5 {
+		t.Errorf("kit dir %q hold %g, want hits 0.5", kit.Dir, kit.Hold)
+	}
+	for key, want := range map[int]string{36: "mouth_pop", 60: "clap", 38: "snare"} {
+		if kit.Names[key] != want {
+			t.Errorf("key %d = %q, want %q", key, kit.Names[key], want)
+		}
+	}
+
+	defaults := filepath.Join(dir, "defaults.json")
+	if err := os.WriteFile(defaults, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if kit, err := LoadDrumKit(defaults); err != nil || kit.Dir != "temp_drums" || kit.Hold != 0.3 {
+		t.Errorf("LoadDrumKit({}) = %+v, %v, want temp_drums with hold 0.3", kit, err)
+	}
+
+	for _, bad := range []string{`{"clips": {"kick": "pop"}}`, `{"clips": {"128": "pop"}}`, `{`} {
+		if err := os.WriteFile(path, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadDrumKit(path); err == nil {
+			t.Errorf("LoadDrumKit(%s) did not fail", bad)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package buildoutput
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"hello/cmdrun"
+	"hello/ffgraph"
+)
+
+// Effect is one stage of an audio effects chain.
+type Effect struct {
+	Type string `json:"type"` // reverb, eq or delay
+
+	// reverb and delay
+	Mix float64 `json:"mix"` // wet level, 0 to 1
+
+	// reverb: convolution with an impulse response WAV, or an aecho room
+	// built from RoomMS when IR is empty
+	IR     string  `json:"ir"`
+	RoomMS float64 `json:"room_ms"`
+
+	// eq: one peaking band
+	Freq float64 `json:"freq"`
+	Gain float64 `json:"gain"` // dB
+	Q    float64 `json:"q"`
+
+	// delay
+	DelayMS  float64 `json:"delay_ms"`
+	Feedback float64 `json:"feedback"`
+}
+
+// EffectsConfig declares a chain per MIDI track (keyed by track number) and
+// a global chain applied to the note mix after the track chains.
+type EffectsConfig struct {
+	Global []Effect            `json:"global"`
+	Tracks map[string][]Effect `json:"tracks"`
+
+	tracks map[int][]Effect
+}
+
+// Effects is the effects configuration for the render; empty means dry.
+var Effects EffectsConfig
+
+// LoadEffects reads and validates an effects config file.
+func LoadEffects(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read effects: %w", err)
+	}
+	var cfg EffectsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse effects %s: %w", path, err)
+	}
+
+	cfg.tracks = map[int][]Effect{}
+	for key, chain := range cfg.Tracks {
+		track, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("effects: track key %q is not a track number", key)
+		}
+		if err := validateChain(chain); err != nil {
+			return fmt.Errorf("effects for track %d: %w", track, err)
+		}
+		cfg.tracks[track] = chain
+	}
+	if err := validateChain(cfg.Global); err != nil {
+		return fmt.Errorf("global effects: %w", err)
+	}
+
+	Effects = cfg
+	return nil
+}
+
+func validateChain(chain []Effect) error {
+	for i, fx := range chain {
+		switch fx.Type {
+		case "reverb":
+			if fx.IR != "" {
+				if _, err := os.Stat(fx.IR); err != nil {
+					return fmt.Errorf("effect %d: %w", i, err)
+				}
+			}
+		case "eq":
+			if fx.Freq <= 0 {
+				return fmt.Errorf("effect %d: eq needs a freq", i)
+			}
+		case "delay":
+			if fx.DelayMS <= 0 || fx.Feedback < 0 || fx.Feedback >= 1 {
+				return fmt.Errorf("effect %d: delay needs delay_ms > 0 and 0 <= feedback < 1", i)
+			}
+		default:
+			return fmt.Errorf("effect %d: unknown type %q", i, fx.Type)
+		}
+		if fx.Mix < 0 || fx.Mix > 1 {
+			return fmt.Errorf("effect %d: mix must be between 0 and 1", i)
+		}
+	}
+	return nil
+}
+
+// trackChain returns the effects chain of a MIDI track.
+func (c EffectsConfig) trackChain(track int) []Effect {
+	return c.tracks[track]
+}
+
+// hasTrackChains reports whether any track has its own chain, in which case
+// notes are mixed to per-track buses first.
+func (c EffectsConfig) hasTrackChains() bool {
+	return len(c.tracks) > 0
+}
+
+// applyEffects appends the chain to in and returns the processed pad.
+func applyEffects(g *ffgraph.Graph, in ffgraph.Pad, chain []Effect) ffgraph.Pad {
+	for _, fx := range chain {
+		switch fx.Type {
+		case "eq":
+			q := fx.Q
+			if q <= 0 {
+				q = 1
+			}
+			in = g.Apply(in, "fx", ffgraph.NewFilter("equalizer").
+				Setf("f", "%g", fx.Freq).
+				Set("t", "q").
+				Setf("w", "%g", q).
+				Setf("g", "%g", fx.Gain))
+
+		case "delay":
+			// Feed-forward taps at multiples of the delay time, each quieter by
+			// the feedback factor, until they fall below -60dB
+			delays, decays := "", ""
+			for tap, level := 1, 1.0; tap <= 16 && level > 0.001; tap, level = tap+1, level*fx.Feedback {
+				if tap > 1 {
+					delays += "|"
+					decays += "|"
+				}
+				delays += strconv.Itoa(int(fx.DelayMS * float64(tap)))
+				decays += fmt.Sprintf("%.4f", level*fx.Mix)
+			}
+			if delays == "" {
+				continue
+			}
+			in = g.Apply(in, "fx", ffgraph.NewFilter("aecho").
+				Set("in_gain", "1").
+				Set("out_gain", "1").
+				Set("delays", delays).
+				Set("decays", decays))
+
+		case "reverb":
+			if fx.IR == "" {
+				room := fx.RoomMS
+				if room <= 0 {
+					room = 40
+				}
+				in = g.Apply(in, "fx", ffgraph.NewFilter("aecho").
+					Set("in_gain", "1").
+					Set("out_gain", "1").
+					Setf("delays", "%d|%d|%d|%d", int(room), int(room*1.7), int(room*2.9), int(room*4.3)).
+					Setf("decays", "%.4f|%.4f|%.4f|%.4f", 0.5*fx.Mix, 0.35*fx.Mix, 0.25*fx.Mix, 0.15*fx.Mix))
+				continue
+			}
+
+			// Convolution: dry and wet paths mixed by weight
+			ir := g.AddInput(fx.IR)
+			split := g.ASplit(in, 2, "fx")
+			wet := g.Combine([]ffgraph.Pad{split[1], g.Stream(ir, "a")}, "fx", ffgraph.NewFilter("afir"))
+			in = g.Combine([]ffgraph.Pad{split[0], wet}, "fx",
+				amixFilter(2, "longest").Setf("weights", "%g %g", 1-fx.Mix, fx.Mix))
+		}
+	}
+	return in
+}
+
+// mixNotes sums the per-note audio into the note mix. With per-track chains
+// the notes of each such track are bussed, processed and then summed with the
+// rest; the global chain is applied last.
+func mixNotes(g *ffgraph.Graph, silence ffgraph.Pad, notes []ffgraph.Pad, tracks []int) ffgraph.Pad {
+	inputs := []ffgraph.Pad{silence}
+
+	if !Effects.hasTrackChains() {
+		inputs = append(inputs, notes...)
+	} else {
+		buses := map[int][]ffgraph.Pad{}
+		for i, pad := range notes {
+			if Effects.trackChain(tracks[i]) == nil {
+				inputs = append(inputs, pad)
+				continue
+			}
+			buses[tracks[i]] = append(buses[tracks[i]], pad)
+		}
+
+		// Deterministic graph order for golden tests
+		order := make([]int, 0, len(buses))
+		for track := range buses {
+			order = append(order, track)
+		}
+		sort.Ints(order)
+
+		for _, track := range order {
+			bus := buses[track][0]
+			if len(buses[track]) > 1 {
+				bus = g.Combine(buses[track], "bus", amixFilter(len(buses[track]), "longest"))
+			}
+			inputs = append(inputs, applyEffects(g, bus, Effects.trackChain(track)))
+		}
+	}
+
+	mixed := g.Combine(inputs, "notes", amixFilter(len(inputs), "longest"))
+	return applyEffects(g, mixed, Effects.Global)
+}
+
+// processPCM runs an interleaved stereo buffer (int16 scale) through an
+// effects chain with ffmpeg, for the compositor. The result has the same
+// length; tails past the end of the buffer are dropped.
+func processPCM(ctx context.Context, pcm []float32, chain []Effect) ([]float32, error) {
+	if len(chain) == 0 {
+		return pcm, nil
+	}
+
+	rate := strconv.Itoa(OutputProfile.SampleRate)
+	g := ffgraph.New()
+	in := g.AddInputWithOptions("-", "-f", "f32le", "-ar", rate, "-ac", strconv.Itoa(compositeChannels))
+	out := applyEffects(g, g.Stream(in, "a"), chain)
+	if out == g.Stream(in, "a") {
+		return pcm, nil
+	}
+	g.Output(out)
+	if err := g.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid effects graph: %w", err)
+	}
+
+	raw := make([]byte, len(pcm)*4)
+	for i, v := range pcm {
+		binary.LittleEndian.PutUint32(raw[4*i:], math.Float32bits(v/math.MaxInt16))
+	}
+
+	args := append([]string{"-v", "error"}, g.InputArgs()...)
+	args = append(args, "-filter_complex", g.String())
+	args = append(args, g.MapArgs()...)
+	args = append(args, "-f", "f32le", "-ar", rate, "-ac", strconv.Itoa(compositeChannels), "-")
+
+	res, err := cmdrun.Silenced(Runner).RunInput(ctx, bytes.NewReader(raw), "ffmpeg", args...)
+	if err != nil {
+		return nil, fmt.Errorf("effects processing failed: %w, output: %s", err, string(res.Stderr))
+	}
+
+	processed := make([]float32, len(pcm))
+	for i := range processed {
+		if 4*i+4 > len(res.Stdout) {
+			break
+		}
+		processed[i] = math.Float32frombits(binary.LittleEndian.Uint32(res.Stdout[4*i:])) * math.MaxInt16
+	}
+	return processed, nil
+}
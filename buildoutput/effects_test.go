@@ -0,0 +1,43 @@
+package buildoutput
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"hello/midiparse"
+)
+
+// The track buses are built in track order, so the graph is stable from run
+// to run even though the buses are collected in a map.
+func TestEffectsGraphOrder(t *testing.T) {
+	want, _ := filepath.Abs("testdata/effects.golden")
+	config := filepath.Join(t.TempDir(), "effects.json")
+	if err := os.WriteFile(config, []byte(`{
+		"tracks": {
+			"2": [{"type": "delay", "delay_ms": 250, "feedback": 0.3, "mix": 0.4}],
+			"1": [{"type": "eq", "freq": 1000, "gain": 3, "q": 1}],
+			"3": [{"type": "reverb", "room_ms": 60, "mix": 0.3}]
+		},
+		"global": [{"type": "eq", "freq": 80, "gain": -2, "q": 0.7}]
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := Effects
+	t.Cleanup(func() { Effects = old })
+	if err := LoadEffects(config); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []midiparse.NoteEvent{
+		{Note: 60, Start: 0, Duration: 1, Track: 3},
+		{Note: 62, Start: 0, Duration: 1, Track: 2},
+		{Note: 64, Start: 0.5, Duration: 1, Track: 1},
+		{Note: 60, Start: 1, Duration: 1, Track: 2},
+		{Note: 62, Start: 1, Duration: 1, Track: 4},
+	}
+	for i := 0; i < 5; i++ {
+		got := renderTest(t, []int{60, 62, 64}, append([]midiparse.NoteEvent(nil), events...))
+		golden(t, want, got)
+	}
+}
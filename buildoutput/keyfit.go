@@ -0,0 +1,182 @@
+package buildoutput
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"hello/midiparse"
+)
+
+// KeyFit is a transposition that fits a song to the recorded library.
+type KeyFit struct {
+	Transpose    int         // semitones applied to every note
+	TrackOctaves map[int]int // extra octaves per MIDI track, after Transpose
+
+	Missing     int // notes with no clip in any octave
+	Substituted int // notes played by the same note in another octave
+	Distance    int // total semitones between the notes and the clips used
+}
+
+// maxTranspose bounds the global transposition search, in semitones.
+const maxTranspose = 12
+
+// LibraryNotes returns the notes that have a clip in temp_vids.
+func LibraryNotes() ([]int, error) {
+	files, err := filepath.Glob("temp_vids/*.mp4")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clip library: %w", err)
+	}
+	var notes []int
+	for _, f := range files {
+		n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(f), ".mp4"))
+		if err == nil && n >= 0 && n <= 127 {
+			notes = append(notes, n)
+		}
+	}
+	sort.Ints(notes)
+	return notes, nil
+}
+
+// clipFor mirrors resolveClip over a set of library notes: the exact note,
+// else the same note in the lowest recorded octave. ok is false when the
+// pitch class was never recorded.
+func clipFor(note int, library map[int]bool) (int, bool) {
+	if library[note] {
+		return note, true
+	}
+	for octave := 0; octave <= 10; octave++ {
+		if c := octave*12 + note%12; c <= 127 && library[c] {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// score counts how well notes shifted by shift are covered by the library.
+func (k *KeyFit) score(notes []int, shift int, library map[int]bool) {
+	for _, n := range notes {
+		n += shift
+		if n < 0 || n > 127 {
+			k.Missing++
+			continue
+		}
+		c, ok := clipFor(n, library)
+		if !ok {
+			k.Missing++
+			continue
+		}
+		if c != n {
+			k.Substituted++
+			k.Distance += abs(c - n)
+		}
+	}
+}
+
+// better orders fits: fewer missing notes, then fewer substitutions, then less
+// pitch-shift distance, then the smaller transposition.
+func (k KeyFit) better(o KeyFit) bool {
+	if k.Missing != o.Missing {
+		return k.Missing < o.Missing
+	}
+	if k.Substituted != o.Substituted {
+		return k.Substituted < o.Substituted
+	}
+	if k.Distance != o.Distance {
+		return k.Distance < o.Distance
+	}
+	return abs(k.Transpose) < abs(o.Transpose)
+}
+
+// FitKey finds the global transposition within an octave either way that
+// best covers events with the library, then, if perTrack is set, the octave
+// shift of each track (up to two either way) that improves it further.
+func FitKey(events []midiparse.NoteEvent, libraryNotes []int, perTrack bool) KeyFit {
+	library := map[int]bool{}
+	for _, n := range libraryNotes {
+		library[n] = true
+	}
+	tracks := map[int][]int{}
+	var all []int
+	for _, e := range events {
+		if e.IsDrum() {
+			continue
+		}
+		tracks[e.Track] = append(tracks[e.Track], e.Note)
+		all = append(all, e.Note)
+	}
+
+	best := KeyFit{Missing: len(all) + 1}
+	for shift := -maxTranspose; shift <= maxTranspose; shift++ {
+		fit := KeyFit{Transpose: shift}
+		fit.score(all, shift, library)
+		if fit.better(best) {
+			best = fit
+		}
+	}
+	best.TrackOctaves = map[int]int{}
+	if !perTrack {
+		return best
+	}
+
+	total := KeyFit{Transpose: best.Transpose, TrackOctaves: map[int]int{}}
+	for track, notes := range tracks {
+		// Smaller shifts come first and win ties
+		var bestTrack KeyFit
+		bestOctaves := 0
+		for i, octaves := range []int{0, -1, 1, -2, 2} {
+			var fit KeyFit
+			fit.score(notes, best.Transpose+12*octaves, library)
+			if i == 0 || fit.better(bestTrack) {
+				bestTrack, bestOctaves = fit, octaves
+			}
+		}
+		if bestOctaves != 0 {
+			total.TrackOctaves[track] = bestOctaves
+		}
+		total.Missing += bestTrack.Missing
+		total.Substituted += bestTrack.Substituted
+		total.Distance += bestTrack.Distance
+	}
+	return total
+}
+
+// Apply transposes events by the fit, returning a new slice. Drum channel
+// events keep their keys. A note moved outside the MIDI range 0-127 is an error.
+func (k KeyFit) Apply(events []midiparse.NoteEvent) ([]midiparse.NoteEvent, error) {
+	out := make([]midiparse.NoteEvent, len(events))
+	for i, e := range events {
+		if !e.IsDrum() {
+			note := e.Note + k.Transpose + 12*k.TrackOctaves[e.Track]
+			if note < 0 || note > 127 {
+				return nil, fmt.Errorf("note %d on track %d at %.3fs transposes to %d, outside the MIDI range", e.Note, e.Track, e.Start, note)
+			}
+			e.Note = note
+		}
+		out[i] = e
+	}
+	return out, nil
+}
+
+// String describes the fit for the user.
+func (k KeyFit) String() string {
+	s := fmt.Sprintf("transpose %+d semitones", k.Transpose)
+	tracks := make([]int, 0, len(k.TrackOctaves))
+	for t := range k.TrackOctaves {
+		tracks = append(tracks, t)
+	}
+	sort.Ints(tracks)
+	for _, t := range tracks {
+		s += fmt.Sprintf(", track %d %+d octaves", t, k.TrackOctaves[t])
+	}
+	return s + fmt.Sprintf(" (%d missing, %d in another octave, %d semitones of substitution)", k.Missing, k.Substituted, k.Distance)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,130 @@
+package buildoutput
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"hello/midiparse"
+)
+
+func notesOn(track int, notes ...int) []midiparse.NoteEvent {
+	events := make([]midiparse.NoteEvent, len(notes))
+	for i, n := range notes {
+		events[i] = midiparse.NoteEvent{Note: n, Track: track, Start: float64(i)}
+	}
+	return events
+}
+
+func TestLibraryNotes(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("temp_vids", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"064.mp4", "060.mp4", "200.mp4", "abc.mp4", "062.txt"} {
+		if err := os.WriteFile(filepath.Join("temp_vids", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := LibraryNotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{60, 64}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LibraryNotes = %v, want %v", got, want)
+	}
+}
+
+func TestClipFor(t *testing.T) {
+	library := map[int]bool{60: true, 64: true, 79: true}
+	tests := []struct {
+		note, want int
+		ok         bool
+	}{
+		{60, 60, true},
+		{72, 60, true}, // C from the lowest recorded octave
+		{43, 79, true}, // G only recorded high up
+		{61, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := clipFor(tt.note, library)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("clipFor(%d) = %d, %v, want %d, %v", tt.note, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFitKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []midiparse.NoteEvent
+		library  []int
+		perTrack bool
+		want     KeyFit
+	}{
+		{
+			name:    "already fits",
+			events:  notesOn(0, 60, 62, 64),
+			library: []int{60, 62, 64},
+			want:    KeyFit{TrackOctaves: map[int]int{}},
+		},
+		{
+			name:    "down a semitone",
+			events:  notesOn(0, 61, 63, 65),
+			library: []int{60, 62, 64},
+			want:    KeyFit{Transpose: -1, TrackOctaves: map[int]int{}},
+		},
+		{
+			name:    "uncoverable notes count as missing",
+			events:  notesOn(0, 60, 61),
+			library: []int{60},
+			want:    KeyFit{Missing: 1, TrackOctaves: map[int]int{}},
+		},
+		{
+			name:    "global search only substitutes the high track",
+			events:  append(notesOn(0, 60, 62), notesOn(1, 84, 86)...),
+			library: []int{60, 62, 64},
+			want:    KeyFit{Substituted: 2, Distance: 48, TrackOctaves: map[int]int{}},
+		},
+		{
+			name:     "per-track octaves bring the high track down",
+			events:   append(notesOn(0, 60, 62), notesOn(1, 84, 86)...),
+			library:  []int{60, 62, 64},
+			perTrack: true,
+			want:     KeyFit{TrackOctaves: map[int]int{1: -2}},
+		},
+	}
+	for _, tt := range tests {
+		if got := FitKey(tt.events, tt.library, tt.perTrack); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: FitKey = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeyFitApply(t *testing.T) {
+	// Drum channel events are not pitches, with or without a drum kit
+	events := append(notesOn(0, 60), notesOn(1, 84)...)
+	events = append(events, midiparse.NoteEvent{Note: 36, Channel: midiparse.DrumChannel})
+
+	// The drum hit is ignored by the search and keeps its key
+	fit := FitKey(events, []int{61}, true)
+	if fit.Missing != 0 {
+		t.Errorf("FitKey counted the drum hit: %+v", fit)
+	}
+	got, err := KeyFit{Transpose: 1, TrackOctaves: map[int]int{1: -2}}.Apply(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{61, 61, 36} {
+		if got[i].Note != want {
+			t.Errorf("event %d: note %d, want %d", i, got[i].Note, want)
+		}
+	}
+
+	for _, k := range []KeyFit{{Transpose: 44}, {Transpose: -61}, {TrackOctaves: map[int]int{1: 4}}} {
+		if _, err := k.Apply(events); err == nil {
+			t.Errorf("%+v: Apply did not reject a note outside 0-127", k)
+		}
+	}
+}
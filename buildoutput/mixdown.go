@@ -0,0 +1,165 @@
+package buildoutput
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"hello/cmdrun"
+	"hello/ffgraph"
+)
+
+// Mixdown controls how notes are summed and how the master bus is finished.
+// Every voice gets the same fixed gain (amix normalize=0), so a dense batch
+// is not quieter than a sparse one; the master bus compresses and limits each
+// segment; and loudness is normalised once over the finished song, so all
+// segments share one gain.
+type Mixdown struct {
+	VoiceGainDB  float64 // gain of every note voice
+	Compress     bool    // gentle master compressor before the limiter
+	LimitDB      float64 // limiter ceiling in dBFS
+	LoudnessLUFS float64 // integrated loudness target; 0 disables normalisation
+	TruePeakDB   float64 // true-peak ceiling for loudness normalisation
+}
+
+// Mix is the mixdown used for every render.
+var Mix = Mixdown{
+	VoiceGainDB:  -6,
+	Compress:     true,
+	LimitDB:      -1,
+	LoudnessLUFS: -14,
+	TruePeakDB:   -1,
+}
+
+// amixFilter sums its inputs without amix's default 1/N scaling.
+func amixFilter(inputs int, duration string) *ffgraph.Filter {
+	return ffgraph.NewFilter("amix").
+		Setf("inputs", "%d", inputs).
+		Set("duration", duration).
+		Set("normalize", "0")
+}
+
+// masterBus appends the compressor and limiter to the final mix of a segment.
+func masterBus(g *ffgraph.Graph, in ffgraph.Pad) ffgraph.Pad {
+	var filters []*ffgraph.Filter
+	if Mix.Compress {
+		filters = append(filters, ffgraph.NewFilter("acompressor").
+			Set("threshold", "-18dB").
+			Set("ratio", "3").
+			Set("attack", "10").
+			Set("release", "200"))
+	}
+	filters = append(filters, ffgraph.NewFilter("alimiter").
+		Setf("limit", "%.4f", dbToLinear(Mix.LimitDB)).
+		Set("level", "0"))
+	return g.Apply(in, "master", filters...)
+}
+
+// limitPCM is the compositor's master bus: a peak limiter with instant attack
+// and a short release, holding the mix under the limiter ceiling.
+func limitPCM(mix []float32) {
+	ceiling := dbToLinear(Mix.LimitDB) * math.MaxInt16
+	release := math.Exp(-1 / (0.05 * float64(OutputProfile.SampleRate)))
+
+	gain := 1.0
+	for i := 0; i+1 < len(mix); i += compositeChannels {
+		peak := math.Max(math.Abs(float64(mix[i])), math.Abs(float64(mix[i+1])))
+		target := 1.0
+		if peak*gain > ceiling {
+			target = ceiling / peak
+		}
+		if target < gain {
+			gain = target
+		} else {
+			gain = release*gain + (1-release)*target
+		}
+		mix[i] = float32(float64(mix[i]) * gain)
+		mix[i+1] = float32(float64(mix[i+1]) * gain)
+	}
+}
+
+// loudnormStats is the JSON printed by loudnorm's first pass.
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// normalizeLoudness runs two-pass loudnorm over the finished file: measure
+// the whole song, then apply one linear gain so every segment moves together.
+// Video is copied.
+func normalizeLoudness(file string) error {
+	if Mix.LoudnessLUFS == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	target := fmt.Sprintf("I=%.1f:TP=%.1f:LRA=11", Mix.LoudnessLUFS, Mix.TruePeakDB)
+
+	fmt.Printf("Measuring loudness of %s (target %.1f LUFS)\n", file, Mix.LoudnessLUFS)
+	res, err := cmdrun.Silenced(Runner).Run(ctx,
+		"ffmpeg",
+		"-i", file,
+		"-vn",
+		"-af", "loudnorm="+target+":print_format=json",
+		"-f", "null",
+		"-",
+	)
+	if err != nil {
+		return fmt.Errorf("loudness measurement failed: %w", err)
+	}
+	stats, err := parseLoudnorm(string(res.Combined()))
+	if err != nil {
+		return err
+	}
+	if stats.InputI == "-inf" {
+		fmt.Println("Output is silent, skipping loudness normalisation")
+		return nil
+	}
+
+	tmp := strings.TrimSuffix(file, filepath.Ext(file)) + ".loudnorm" + filepath.Ext(file)
+	args := []string{
+		"-i", file,
+		"-map", "0:v", "-map", "0:a",
+		"-c:v", "copy",
+		"-af", fmt.Sprintf("loudnorm=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+			target, stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset),
+	}
+	args = append(args, OutputProfile.AudioArgs()...)
+	args = append(args, "-y", tmp)
+
+	if _, err := Runner.Run(ctx, "ffmpeg", args...); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("loudness normalisation failed: %w", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", file, err)
+	}
+	return nil
+}
+
+// parseLoudnorm extracts the JSON block loudnorm prints at the end of its log.
+func parseLoudnorm(output string) (loudnormStats, error) {
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return loudnormStats{}, fmt.Errorf("could not find loudnorm stats in ffmpeg output")
+	}
+	var stats loudnormStats
+	if err := json.Unmarshal([]byte(output[start:end+1]), &stats); err != nil {
+		return loudnormStats{}, fmt.Errorf("could not parse loudnorm stats: %w", err)
+	}
+	if stats.InputI == "" {
+		return loudnormStats{}, fmt.Errorf("loudnorm stats are missing input_i")
+	}
+	return stats, nil
+}
+
+func dbToLinear(db float64) float64 {
+	return math.Pow(10, db/20)
+}
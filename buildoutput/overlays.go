@@ -0,0 +1,334 @@
+package buildoutput
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"hello/ffgraph"
+	"hello/midiparse"
+)
+
+// Overlays selects what is drawn on top of the finished scene.
+type Overlays struct {
+	NoteNames bool // names of the sounding notes, e.g. "C4 E4 G4"
+	Lyrics    bool // MIDI lyrics as karaoke lines, the sung part highlighted
+	PianoRoll bool // scrolling piano-roll strip along the bottom
+}
+
+// Overlay is the overlay selection for the render.
+var Overlay Overlays
+
+// OverlayFont is the font file for text overlays; empty uses fontconfig's default.
+var OverlayFont = ""
+
+// Lyrics are the song's lyric syllables (from Song.KaraokeLyrics), in song time.
+var Lyrics []midiparse.Marker
+
+// Piano roll layout.
+const (
+	rollHeightFraction = 0.18 // of the output height
+	rollPixelsPerSec   = 120  // scroll speed
+)
+
+var (
+	rollBackground = color.RGBA{0, 0, 0, 160}
+	rollNote       = color.RGBA{80, 220, 140, 255}
+	rollPlayhead   = color.RGBA{255, 255, 255, 255}
+)
+
+// songEvents are the pitched events of the song in song time, so the piano
+// roll can show notes before and after the segment being rendered.
+var songEvents []midiparse.NoteEvent
+
+// textOverlayFilters returns drawtext filters for the note name and lyric
+// overlays of a segment. events are relative to the segment start at offset.
+func textOverlayFilters(events []midiparse.NoteEvent, offset, duration float64) []*ffgraph.Filter {
+	var filters []*ffgraph.Filter
+	h := OutputProfile.Height
+
+	if Overlay.NoteNames {
+		for _, span := range soundingSpans(events) {
+			filters = append(filters, drawText(span.text, "(w-text_w)/2", fmt.Sprintf("%d", h/12), h/14, "white").
+				Setf("enable", "between(t,%.3f,%.3f)", span.start, span.end))
+		}
+	}
+
+	if Overlay.Lyrics {
+		y := h - h/6
+		if Overlay.PianoRoll {
+			y = h - int(float64(h)*rollHeightFraction) - h/10
+		}
+		for _, line := range karaokeLines(Lyrics, offset, duration) {
+			x := fmt.Sprintf("%d", OutputProfile.Width/10)
+			filters = append(filters, drawText(line.text, x, fmt.Sprintf("%d", y), h/18, "white").
+				Setf("enable", "between(t,%.3f,%.3f)", line.start, line.end))
+			for k, sung := range line.sung {
+				end := line.end
+				if k+1 < len(line.sung) {
+					end = line.sung[k+1].start
+				}
+				filters = append(filters, drawText(sung.text, x, fmt.Sprintf("%d", y), h/18, "yellow").
+					Setf("enable", "between(t,%.3f,%.3f)", sung.start, end))
+			}
+		}
+	}
+	return filters
+}
+
+func drawText(text, x, y string, size int, fontColor string) *ffgraph.Filter {
+	f := ffgraph.NewFilter("drawtext")
+	if OverlayFont != "" {
+		f.Set("fontfile", OverlayFont)
+	}
+	return f.Set("text", text).
+		Set("expansion", "none").
+		Set("x", x).
+		Set("y", y).
+		Setf("fontsize", "%d", size).
+		Set("fontcolor", fontColor).
+		Set("borderw", "2").
+		Set("bordercolor", "black")
+}
+
+// textSpan is a piece of text shown from start to end.
+type textSpan struct {
+	start, end float64
+	text       string
+}
+
+// soundingSpans splits the timeline wherever the set of sounding notes
+// changes and names the notes sounding in each piece.
+func soundingSpans(events []midiparse.NoteEvent) []textSpan {
+	var times []float64
+	for _, e := range events {
+		if e.IsDrum() {
+			continue
+		}
+		times = append(times, e.Start, e.Start+e.Duration)
+	}
+	sort.Float64s(times)
+
+	var spans []textSpan
+	for i := 0; i+1 < len(times); i++ {
+		start, end := times[i], times[i+1]
+		if end-start < 0.001 {
+			continue
+		}
+		var notes []int
+		for _, e := range events {
+			if !e.IsDrum() && e.Start <= start && e.Start+e.Duration >= end {
+				notes = append(notes, e.Note)
+			}
+		}
+		if len(notes) == 0 {
+			continue
+		}
+		sort.Ints(notes)
+		names := make([]string, 0, len(notes))
+		for j, n := range notes {
+			if j == 0 || n != notes[j-1] {
+				names = append(names, midiparse.NoteName(n))
+			}
+		}
+		text := strings.Join(names, " ")
+		if len(spans) > 0 && spans[len(spans)-1].text == text && spans[len(spans)-1].end == start {
+			spans[len(spans)-1].end = end
+			continue
+		}
+		spans = append(spans, textSpan{start, end, text})
+	}
+	return spans
+}
+
+// karaokeLine is a lyric line with the growing sung prefix at each syllable.
+type karaokeLine struct {
+	textSpan
+	sung []textSpan
+}
+
+// karaokeLines groups syllables into lines and returns the lines visible in
+// the segment [offset, offset+duration), in segment time. A line breaks on
+// the .kar "/" and "\" prefixes or a trailing newline; a line stays up until
+// the next one starts, at most 2 seconds after its last syllable.
+func karaokeLines(lyrics []midiparse.Marker, offset, duration float64) []karaokeLine {
+	var lines []karaokeLine
+	var cur *karaokeLine
+	flush := func() {
+		if cur != nil && len(cur.sung) > 0 {
+			lines = append(lines, *cur)
+		}
+		cur = nil
+	}
+	for _, syl := range lyrics {
+		text := syl.Text
+		if strings.HasPrefix(text, "/") || strings.HasPrefix(text, "\\") {
+			flush()
+			text = text[1:]
+		}
+		breakAfter := strings.HasSuffix(text, "\n") || strings.HasSuffix(text, "\r")
+		text = strings.TrimRight(text, "\r\n")
+
+		if cur == nil {
+			cur = &karaokeLine{textSpan: textSpan{start: syl.Time}}
+		}
+		cur.text += text
+		cur.sung = append(cur.sung, textSpan{start: syl.Time, text: cur.text})
+		if breakAfter {
+			flush()
+		}
+	}
+	flush()
+
+	var visible []karaokeLine
+	for i, line := range lines {
+		line.end = line.sung[len(line.sung)-1].start + 2
+		if i+1 < len(lines) {
+			line.end = math.Min(line.end, lines[i+1].start)
+		}
+		line.text = strings.TrimSpace(line.text)
+		if line.end <= offset || line.start >= offset+duration {
+			continue
+		}
+		line.start -= offset
+		line.end -= offset
+		for k := range line.sung {
+			line.sung[k].start -= offset
+			line.sung[k].text = strings.TrimSpace(line.sung[k].text)
+		}
+		visible = append(visible, line)
+	}
+	return visible
+}
+
+// renderRoll draws the piano roll for song time [from, to) at
+// rollPixelsPerSec, one row per note between the song's lowest and highest.
+func renderRoll(from, to float64) *image.RGBA {
+	w := int(math.Ceil((to - from) * rollPixelsPerSec))
+	h := int(float64(OutputProfile.Height) * rollHeightFraction)
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = rollBackground.R, rollBackground.G, rollBackground.B, rollBackground.A
+	}
+	if len(songEvents) == 0 {
+		return img
+	}
+
+	low, high := songEvents[0].Note, songEvents[0].Note
+	for _, e := range songEvents {
+		low, high = min(low, e.Note), max(high, e.Note)
+	}
+	rowH := float64(h) / float64(high-low+1)
+
+	for _, e := range songEvents {
+		x0 := int((e.Start - from) * rollPixelsPerSec)
+		x1 := int((e.Start + e.Duration - from) * rollPixelsPerSec)
+		if x1 <= 0 || x0 >= w {
+			continue
+		}
+		y0 := int(float64(high-e.Note) * rowH)
+		y1 := int(float64(high-e.Note+1)*rowH) - 1
+		for y := max(y0, 0); y <= y1 && y < h; y++ {
+			for x := max(x0, 0); x < x1-1 && x < w; x++ {
+				img.SetRGBA(x, y, rollNote)
+			}
+		}
+	}
+	return img
+}
+
+// addPianoRoll renders the roll for a segment to a PNG next to the output and
+// overlays it, scrolling, along the bottom of in. The playhead is the centre
+// of the strip. It returns the overlaid pad and the PNG path to remove.
+func addPianoRoll(g *ffgraph.Graph, in ffgraph.Pad, outputFile string, offset, duration float64) (ffgraph.Pad, string, error) {
+	w := OutputProfile.Width
+	half := float64(w) / 2 / rollPixelsPerSec
+	img := renderRoll(offset-half, offset+duration+half)
+	h := img.Bounds().Dy()
+
+	path := strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".roll.png"
+	f, err := os.Create(path)
+	if err != nil {
+		return in, "", fmt.Errorf("failed to write piano roll: %w", err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return in, "", fmt.Errorf("failed to write piano roll: %w", err)
+	}
+	f.Close()
+
+	roll := g.AddInputWithOptions(path, "-loop", "1", "-framerate", fmt.Sprintf("%d", OutputProfile.FPS))
+	strip := g.Apply(g.Stream(roll, "v"), "roll",
+		ffgraph.NewFilter("trim").Setf("duration", "%.3f", duration),
+		ffgraph.NewFilter("format").Arg("rgba"),
+		ffgraph.NewFilter("crop").Argf("%d", w).Argf("%d", h).Argf("t*%d", rollPixelsPerSec).Arg("0"),
+		ffgraph.NewFilter("drawbox").Setf("x", "%d", w/2).Set("y", "0").Set("w", "2").Setf("h", "%d", h).Set("color", "white").Set("t", "fill"))
+	out := g.Combine([]ffgraph.Pad{in, strip}, "roll",
+		ffgraph.NewFilter("overlay").Set("x", "0").Setf("y", "%d", OutputProfile.Height-h).Set("shortest", "0").Set("eof_action", "pass"))
+	return out, path, nil
+}
+
+// addOverlays draws the enabled overlays over the finished scene of a segment.
+// It returns the final pad and any temporary files to remove after encoding.
+func addOverlays(g *ffgraph.Graph, in ffgraph.Pad, events []midiparse.NoteEvent, outputFile string, offset, duration float64) (ffgraph.Pad, []string, error) {
+	var temp []string
+	if Overlay.PianoRoll {
+		out, path, err := addPianoRoll(g, in, outputFile, offset, duration)
+		if err != nil {
+			return in, nil, err
+		}
+		in, temp = out, append(temp, path)
+	}
+	if text := textOverlayFilters(events, offset, duration); len(text) > 0 {
+		in = g.Apply(in, "text", text...)
+	}
+	return in, temp, nil
+}
+
+// rollStrip is the compositor's piano roll: the whole song's roll, blitted
+// at the scroll position of each frame.
+type rollStrip struct {
+	img *image.RGBA
+}
+
+// newRollStrip renders the roll for a composited render, or nil when disabled.
+func newRollStrip(maxEnd float64) *rollStrip {
+	if !Overlay.PianoRoll {
+		return nil
+	}
+	half := float64(OutputProfile.Width) / 2 / rollPixelsPerSec
+	return &rollStrip{img: renderRoll(-half, maxEnd+half)}
+}
+
+// draw blends the strip for time t over the bottom of frame, with the playhead.
+func (r *rollStrip) draw(frame []byte, t float64) {
+	if r == nil {
+		return
+	}
+	w, h := OutputProfile.Width, r.img.Bounds().Dy()
+	top := OutputProfile.Height - h
+	x0 := int(t * rollPixelsPerSec)
+	for y := 0; y < h; y++ {
+		src := r.img.Pix[y*r.img.Stride:]
+		dst := frame[(top+y)*w*4 : (top+y+1)*w*4]
+		for x := 0; x < w; x++ {
+			px := rollBackground
+			if sx := x0 + x; sx < r.img.Bounds().Dx() {
+				px = color.RGBA{src[sx*4], src[sx*4+1], src[sx*4+2], src[sx*4+3]}
+			}
+			if x == w/2 || x == w/2+1 {
+				px = rollPlayhead
+			}
+			a := float64(px.A) / 255
+			dst[x*4] = byte(float64(px.R)*a + float64(dst[x*4])*(1-a))
+			dst[x*4+1] = byte(float64(px.G)*a + float64(dst[x*4+1])*(1-a))
+			dst[x*4+2] = byte(float64(px.B)*a + float64(dst[x*4+2])*(1-a))
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package buildoutput
+
+import (
+	"reflect"
+	"testing"
+
+	"hello/midiparse"
+)
+
+func TestSoundingSpans(t *testing.T) {
+	note := func(n int, start, end float64) midiparse.NoteEvent {
+		return midiparse.NoteEvent{Note: n, Start: start, Duration: end - start}
+	}
+	drum := note(36, 0, 0.5)
+	drum.Channel = midiparse.DrumChannel
+
+	tests := []struct {
+		name   string
+		events []midiparse.NoteEvent
+		want   []textSpan
+	}{
+		{"single note", []midiparse.NoteEvent{note(60, 0, 1)}, []textSpan{{0, 1, "C4"}}},
+		{
+			"overlap",
+			[]midiparse.NoteEvent{note(60, 0, 1), note(64, 0.5, 1.5)},
+			[]textSpan{{0, 0.5, "C4"}, {0.5, 1, "C4 E4"}, {1, 1.5, "E4"}},
+		},
+		{
+			"chord named bottom up once per pitch",
+			[]midiparse.NoteEvent{note(67, 0, 1), note(60, 0, 1), note(60, 0, 1)},
+			[]textSpan{{0, 1, "C4 G4"}},
+		},
+		{
+			"repeated note joins into one span",
+			[]midiparse.NoteEvent{note(60, 0, 1), note(60, 1, 2)},
+			[]textSpan{{0, 2, "C4"}},
+		},
+		{
+			"rest between notes",
+			[]midiparse.NoteEvent{note(60, 0, 1), note(62, 2, 3)},
+			[]textSpan{{0, 1, "C4"}, {2, 3, "D4"}},
+		},
+		{"drums are not named", []midiparse.NoteEvent{drum, note(60, 0, 1)}, []textSpan{{0, 1, "C4"}}},
+	}
+	for _, tt := range tests {
+		if got := soundingSpans(tt.events); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: soundingSpans = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKaraokeLines(t *testing.T) {
+	syllables := func(pairs ...any) []midiparse.Marker {
+		var m []midiparse.Marker
+		for i := 0; i < len(pairs); i += 2 {
+			m = append(m, midiparse.Marker{Time: pairs[i].(float64), Text: pairs[i+1].(string)})
+		}
+		return m
+	}
+	line := func(start, end float64, text string, sung ...textSpan) karaokeLine {
+		return karaokeLine{textSpan: textSpan{start, end, text}, sung: sung}
+	}
+
+	tests := []struct {
+		name             string
+		lyrics           []midiparse.Marker
+		offset, duration float64
+		want             []karaokeLine
+	}{
+		{
+			name:     "slash starts a line",
+			lyrics:   syllables(0.0, "Hel", 0.5, "lo ", 1.0, "/world"),
+			duration: 10,
+			want: []karaokeLine{
+				line(0, 1, "Hello", textSpan{0, 0, "Hel"}, textSpan{0.5, 0, "Hello"}),
+				line(1, 3, "world", textSpan{1, 0, "world"}),
+			},
+		},
+		{
+			name:     "backslash and trailing newline break too",
+			lyrics:   syllables(0.0, "one\n", 3.0, "two", 4.0, "\\three"),
+			duration: 10,
+			want: []karaokeLine{
+				line(0, 2, "one", textSpan{0, 0, "one"}),
+				line(3, 4, "two", textSpan{3, 0, "two"}),
+				line(4, 6, "three", textSpan{4, 0, "three"}),
+			},
+		},
+		{
+			name:     "only lines in the segment, in segment time",
+			lyrics:   syllables(0.0, "Hel", 0.5, "lo ", 1.0, "/world"),
+			offset:   1.5,
+			duration: 1,
+			want:     []karaokeLine{line(-0.5, 1.5, "world", textSpan{-0.5, 0, "world"})},
+		},
+		{name: "no lyrics", duration: 10},
+	}
+	for _, tt := range tests {
+		if got := karaokeLines(tt.lyrics, tt.offset, tt.duration); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: karaokeLines = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderRoll(t *testing.T) {
+	oldEvents, oldProfile := songEvents, OutputProfile
+	t.Cleanup(func() { songEvents, OutputProfile = oldEvents, oldProfile })
+	OutputProfile.Height = 100 // an 18 pixel strip
+	songEvents = []midiparse.NoteEvent{
+		{Note: 60, Start: 0, Duration: 0.5},
+		{Note: 61, Start: 0.5, Duration: 0.5},
+	}
+
+	// Two rows of 9 pixels, the high note on top; one second is 120 pixels
+	img := renderRoll(0, 1)
+	if b := img.Bounds(); b.Dx() != 120 || b.Dy() != 18 {
+		t.Fatalf("roll is %v, want 120x18", b)
+	}
+	tests := []struct {
+		x, y int
+		note bool
+	}{
+		{10, 12, true},  // low note, first half
+		{10, 3, false},  // high row is empty then
+		{70, 3, true},   // high note, second half
+		{70, 12, false}, // low note has ended
+		{59, 12, false}, // a pixel gap before the note end
+	}
+	for _, tt := range tests {
+		if got := img.RGBAAt(tt.x, tt.y) == rollNote; got != tt.note {
+			t.Errorf("pixel (%d,%d) note = %v, want %v", tt.x, tt.y, got, tt.note)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package buildoutput
+
+import (
+	"fmt"
+	"math"
+
+	"hello/ffgraph"
+	"hello/midiparse"
+)
+
+// PanMode decides where each note sits in the stereo image.
+type PanMode string
+
+const (
+	// PanCenter mixes every note dead centre (the original behaviour).
+	PanCenter PanMode = "center"
+	// PanCC10 uses the channel's MIDI CC10 at note start; notes on channels
+	// without CC10 stay centred.
+	PanCC10 PanMode = "cc10"
+	// PanPitch spreads notes by pitch, low on the left and high on the right
+	// like a piano seen from the bench.
+	PanPitch PanMode = "pitch"
+	// PanLayout pans each note to where the performer appears on screen,
+	// using the clip's motion region and the current crop mode.
+	PanLayout PanMode = "layout"
+)
+
+// Pan is the pan mode applied to every note.
+var Pan = PanCenter
+
+// PanWidth scales every pan position, 0 collapsing to mono and 1 allowing hard left/right.
+var PanWidth = 0.8
+
+// Pitch range mapped across the stereo field by PanPitch (C2 to C7).
+const (
+	panLowNote  = 36
+	panHighNote = 96
+)
+
+// notePan returns the pan position of an event in [-1, 1].
+func notePan(e midiparse.NoteEvent, file string) float64 {
+	var pos float64
+	switch Pan {
+	case PanCC10:
+		pos = e.Pan
+	case PanPitch:
+		pos = 2*(float64(e.Note-panLowNote)/float64(panHighNote-panLowNote)) - 1
+	case PanLayout:
+		x, err := screenX(file)
+		if err != nil {
+			fmt.Printf("No layout pan for %s, centring: %v\n", file, err)
+			return 0
+		}
+		pos = 2*x - 1
+	}
+	return math.Max(-1, math.Min(1, pos*PanWidth))
+}
+
+// panGains returns equal-power left/right gains: each channel is at -3 dB at
+// centre and a hard-panned note is at full level on one side, so the note's
+// loudness is the same wherever it sits.
+func panGains(pos float64) (float64, float64) {
+	angle := (pos + 1) * math.Pi / 4
+	return math.Cos(angle), math.Sin(angle)
+}
+
+// noteGains returns the left/right gains of a note. PanCenter leaves both
+// channels at full level, as before panning existed.
+func noteGains(e midiparse.NoteEvent, file string) (float64, float64) {
+	if Pan == PanCenter {
+		return 1, 1
+	}
+	return panGains(notePan(e, file))
+}
+
+// panFilter returns the pan filter for a note, or nil under PanCenter.
+func panFilter(e midiparse.NoteEvent, file string) *ffgraph.Filter {
+	if Pan == PanCenter {
+		return nil
+	}
+	l, r := panGains(notePan(e, file))
+	return ffgraph.NewFilter("pan").Argf("stereo|c0=%.4f*c0|c1=%.4f*c1", l, r)
+}
+
+// screenX returns the horizontal centre of the clip's motion region as a
+// fraction of the output width, after the crop mode has been applied.
+func screenX(file string) (float64, error) {
+	region, err := detectMotion(file)
+	if err != nil {
+		return 0, err
+	}
+	cx := float64(region.motion.X) + float64(region.motion.W)/2
+	srcW, srcH := float64(region.srcW), float64(region.srcH)
+	w, h := float64(OutputProfile.Width), float64(OutputProfile.Height)
+
+	switch Crop {
+	case CropManual, CropAuto:
+		box, ok := ManualCrops[file]
+		if Crop == CropAuto {
+			box, ok = aspectCrop(region.motion, region.srcW, region.srcH, w/h), true
+		}
+		if ok {
+			return clampUnit((cx - float64(box.X)) / float64(box.W)), nil
+		}
+		fallthrough
+	case CropCenter:
+		scale := math.Max(w/srcW, h/srcH)
+		return clampUnit((cx*scale - (srcW*scale-w)/2) / w), nil
+	default: // fit
+		scale := math.Min(w/srcW, h/srcH)
+		return clampUnit(((w-srcW*scale)/2 + cx*scale) / w), nil
+	}
+}
+
+func clampUnit(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,50 @@
+package buildoutput
+
+import (
+	"math"
+	"testing"
+
+	"hello/midiparse"
+)
+
+func TestPanGains(t *testing.T) {
+	centreL, centreR := panGains(0)
+	for _, pos := range []float64{-1, -0.5, 0, 0.3, 1} {
+		l, r := panGains(pos)
+		if p := l*l + r*r; math.Abs(p-1) > 1e-9 {
+			t.Errorf("panGains(%g) power = %g, want 1", pos, p)
+		}
+		if l > 1+1e-9 || r > 1+1e-9 {
+			t.Errorf("panGains(%g) = %g, %g, above full level", pos, l, r)
+		}
+	}
+	if math.Abs(centreL-centreR) > 1e-9 || math.Abs(centreL-math.Sqrt2/2) > 1e-9 {
+		t.Errorf("panGains(0) = %g, %g, want -3 dB each", centreL, centreR)
+	}
+	if l, r := panGains(-1); math.Abs(l-1) > 1e-9 || math.Abs(r) > 1e-9 {
+		t.Errorf("panGains(-1) = %g, %g, want hard left", l, r)
+	}
+}
+
+func TestNoteGains(t *testing.T) {
+	oldPan, oldWidth := Pan, PanWidth
+	t.Cleanup(func() { Pan, PanWidth = oldPan, oldWidth })
+	e := midiparse.NoteEvent{Note: 60, Pan: 1}
+
+	Pan = PanCenter
+	if l, r := noteGains(e, ""); l != 1 || r != 1 {
+		t.Errorf("centre mode gains = %g, %g, want 1, 1", l, r)
+	}
+	if f := panFilter(e, ""); f != nil {
+		t.Errorf("centre mode added a pan filter")
+	}
+
+	Pan, PanWidth = PanCC10, 0.5
+	l, r := noteGains(e, "")
+	if wl, wr := panGains(0.5); l != wl || r != wr {
+		t.Errorf("cc10 gains = %g, %g, want %g, %g scaled by the width", l, r, wl, wr)
+	}
+	if f := panFilter(e, ""); f == nil {
+		t.Errorf("cc10 mode added no pan filter")
+	}
+}
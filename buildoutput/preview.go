@@ -0,0 +1,158 @@
+package buildoutput
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"hello/cmdrun"
+	"hello/midiparse"
+)
+
+// previewChunk is how much audio the preview mixes per write. It bounds the
+// latency added on top of ffplay's own buffering.
+const previewChunk = 10 * time.Millisecond
+
+// Preview plays note clips live while a performance is recorded. The clip
+// library is decoded to PCM up front and every note is mixed into one raw
+// stream fed to a single long-running ffplay, so a note-on costs a mix
+// rather than a process start.
+type Preview struct {
+	mu     sync.Mutex
+	clips  map[string]*decodedClip
+	voices []previewVoice
+
+	cancel context.CancelFunc
+	pipe   *io.PipeWriter
+	done   chan struct{}
+}
+
+// previewVoice is a sounding clip and how far it has played.
+type previewVoice struct {
+	samples []int16
+	pos     int
+	gain    float64
+}
+
+// StartPreview decodes the clip library (and the drum kit, when one is set)
+// and starts the player. Close stops it.
+func StartPreview(ctx context.Context) (*Preview, error) {
+	files, err := filepath.Glob("temp_vids/*.mp4")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clip library: %w", err)
+	}
+	if Drums != nil {
+		hits, err := filepath.Glob(filepath.Join(Drums.Dir, "*.mp4"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list drum kit: %w", err)
+		}
+		files = append(files, hits...)
+	}
+
+	p := &Preview{clips: map[string]*decodedClip{}}
+	for _, file := range files {
+		clip, err := decodeClip(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		p.clips[file] = clip
+	}
+	fmt.Printf("Preview: %d clips loaded\n", len(p.clips))
+
+	ctx, p.cancel = context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	p.pipe = pw
+	p.done = make(chan struct{})
+	go func() {
+		_, err := cmdrun.Silenced(Runner).RunInput(ctx, pr, "ffplay",
+			"-nodisp", "-loglevel", "quiet",
+			"-fflags", "nobuffer", "-flags", "low_delay",
+			"-f", "s16le",
+			"-sample_rate", fmt.Sprintf("%d", OutputProfile.SampleRate),
+			"-ch_layout", "stereo",
+			"-i", "-",
+		)
+		pr.CloseWithError(io.ErrClosedPipe)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Preview player stopped: %v\n", err)
+		}
+		close(p.done)
+	}()
+	go p.play(ctx)
+	return p, nil
+}
+
+// Note starts the clip of a note at a volume following its velocity. Drum
+// notes play from the drum kit when one is set.
+func (p *Preview) Note(channel, note, velocity int) {
+	file, err := resolveEventClip(midiparse.NoteEvent{Note: note, Channel: channel})
+	if err != nil {
+		fmt.Printf("No preview: %v\n", err)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clip, ok := p.clips[file]
+	if !ok {
+		fmt.Printf("No preview: %s was not loaded\n", file)
+		return
+	}
+	p.voices = append(p.voices, previewVoice{samples: clip.samples, gain: float64(velocity) / 127})
+}
+
+// play writes one chunk of mixed audio per tick until the context ends.
+func (p *Preview) play(ctx context.Context) {
+	frames := int(float64(OutputProfile.SampleRate) * previewChunk.Seconds())
+	buf := make([]byte, frames*compositeChannels*2)
+	ticker := time.NewTicker(previewChunk)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.mix(buf)
+		if _, err := p.pipe.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+// mix fills buf with the next samples of every sounding voice as 16-bit
+// little-endian PCM and drops voices that have finished.
+func (p *Preview) mix(buf []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := 0; i < len(buf)/2; i++ {
+		sum := 0.0
+		for _, v := range p.voices {
+			if v.pos+i < len(v.samples) {
+				sum += float64(v.samples[v.pos+i]) * v.gain
+			}
+		}
+		binary.LittleEndian.PutUint16(buf[2*i:], uint16(int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, sum)))))
+	}
+
+	kept := p.voices[:0]
+	for _, v := range p.voices {
+		v.pos += len(buf) / 2
+		if v.pos < len(v.samples) {
+			kept = append(kept, v)
+		}
+	}
+	p.voices = kept
+}
+
+// Close stops the player and waits for it to exit.
+func (p *Preview) Close() {
+	p.cancel()
+	p.pipe.Close()
+	<-p.done
+}
@@ -0,0 +1,26 @@
+package buildoutput
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestPreviewMix(t *testing.T) {
+	p := &Preview{voices: []previewVoice{
+		{samples: []int16{1000, 1000, 1000, 1000, 1000, 1000}, gain: 1},
+		{samples: []int16{30000, 30000}, gain: 0.5},
+		{samples: []int16{30000, 30000, 30000, 30000}, gain: 1},
+	}}
+	buf := make([]byte, 8) // two stereo frames
+	p.mix(buf)
+
+	want := []int16{32767, 32767, 31000, 31000}
+	for i, w := range want {
+		if got := int16(binary.LittleEndian.Uint16(buf[2*i:])); got != w {
+			t.Errorf("sample %d = %d, want %d", i, got, w)
+		}
+	}
+	if len(p.voices) != 1 || p.voices[0].pos != 4 {
+		t.Errorf("voices after one chunk = %+v, want only the first at 4", p.voices)
+	}
+}
@@ -0,0 +1,134 @@
+package buildoutput
+
+import (
+	"fmt"
+	"math"
+
+	"hello/ffgraph"
+	"hello/midiparse"
+)
+
+// TransitionKind is how a note's layer enters over the one before it.
+type TransitionKind string
+
+const (
+	// TransitionCut is a hard cut (the original behaviour).
+	TransitionCut TransitionKind = "cut"
+	// TransitionFade crossfades: the new layer fades in over the previous one.
+	TransitionFade TransitionKind = "fade"
+	// TransitionWipe reveals the new layer left to right.
+	TransitionWipe TransitionKind = "wipe"
+	// TransitionSlide slides the new layer in from the right.
+	TransitionSlide TransitionKind = "slide"
+)
+
+// Transition is the transition used between consecutive notes.
+var Transition = TransitionCut
+
+// TransitionDuration is the longest a transition may take, in seconds. Each
+// transition is clamped to the gap between the two note starts and to the
+// incoming note's length, so fast passages get shorter transitions.
+var TransitionDuration = 0.15
+
+// transitionSpan is the video timing of one event.
+type transitionSpan struct {
+	in   float64 // transition length at the start of the layer; 0 for a cut
+	show float64 // how long the layer stays on screen, held past the note end to cover the next transition
+}
+
+// planTransitions returns the span of every event (sorted by start) within a
+// segment of length maxEnd.
+func planTransitions(events []midiparse.NoteEvent, maxEnd float64) []transitionSpan {
+	spans := make([]transitionSpan, len(events))
+	for i, e := range events {
+		spans[i].show = e.Duration
+	}
+	if Transition == TransitionCut || TransitionDuration <= 0 {
+		return spans
+	}
+
+	for i := 1; i < len(events); i++ {
+		prev, e := events[i-1], events[i]
+		d := math.Min(TransitionDuration, math.Min(e.Start-prev.Start, e.Duration))
+		if d <= 0 || e.Start < 0 { // held notes came in during the previous segment
+			continue
+		}
+		spans[i].in = d
+
+		// Keep the outgoing note up until the incoming one is fully in, unless
+		// a rest longer than the transition separates them
+		if e.Start-(prev.Start+prev.Duration) <= d {
+			hold := math.Min(e.Start+d, maxEnd) - prev.Start
+			spans[i-1].show = math.Max(spans[i-1].show, hold)
+		}
+	}
+	return spans
+}
+
+// transitionFilters returns the layer filters for an incoming transition,
+// applied while the layer's timestamps start at 0.
+func transitionFilters(span transitionSpan) []*ffgraph.Filter {
+	if span.in <= 0 {
+		return nil
+	}
+	switch Transition {
+	case TransitionFade:
+		return []*ffgraph.Filter{ffgraph.NewFilter("fade").
+			Set("t", "in").
+			Set("st", "0").
+			Setf("d", "%.3f", span.in).
+			Set("alpha", "1")}
+	case TransitionWipe:
+		return []*ffgraph.Filter{ffgraph.NewFilter("geq").
+			Set("lum", "lum(X,Y)").
+			Set("cb", "cb(X,Y)").
+			Set("cr", "cr(X,Y)").
+			Setf("a", "if(lt(X,W*T/%.3f),alpha(X,Y),0)", span.in)}
+	}
+	return nil
+}
+
+// overlayX returns the overlay x position expression for a layer starting at
+// start, or "" to leave it at 0. Only slide moves the layer.
+func overlayX(start float64, span transitionSpan) string {
+	if Transition != TransitionSlide || span.in <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("if(lt(t,%.3f),W*(1-(t-%.3f)/%.3f),0)", start+span.in, start, span.in)
+}
+
+// applyTransition is the compositor version of transitionFilters and
+// overlayX: it renders src at progress p (0 to 1) of the transition into dst
+// and returns the frame to draw.
+func applyTransition(dst, src []byte, p float64) []byte {
+	if p >= 1 || Transition == TransitionCut {
+		return src
+	}
+	w, h := OutputProfile.Width, OutputProfile.Height
+
+	switch Transition {
+	case TransitionFade:
+		copy(dst, src)
+		for i := 3; i < len(dst); i += 4 {
+			dst[i] = byte(float64(dst[i]) * p)
+		}
+	case TransitionWipe:
+		edge := int(p * float64(w))
+		copy(dst, src)
+		for y := 0; y < h; y++ {
+			for x := edge; x < w; x++ {
+				dst[(y*w+x)*4+3] = 0
+			}
+		}
+	case TransitionSlide:
+		shift := int(float64(w) * (1 - p))
+		for y := 0; y < h; y++ {
+			row := dst[y*w*4 : (y+1)*w*4]
+			clear(row[:shift*4])
+			copy(row[shift*4:], src[y*w*4:(y*w+w-shift)*4])
+		}
+	default:
+		return src
+	}
+	return dst
+}
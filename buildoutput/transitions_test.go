@@ -0,0 +1,115 @@
+package buildoutput
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"hello/midiparse"
+)
+
+func TestPlanTransitions(t *testing.T) {
+	oldKind, oldDuration := Transition, TransitionDuration
+	t.Cleanup(func() { Transition, TransitionDuration = oldKind, oldDuration })
+	TransitionDuration = 0.15
+
+	note := func(start, duration float64) midiparse.NoteEvent {
+		return midiparse.NoteEvent{Note: 60, Start: start, Duration: duration}
+	}
+	tests := []struct {
+		name   string
+		kind   TransitionKind
+		events []midiparse.NoteEvent
+		maxEnd float64
+		want   []transitionSpan
+	}{
+		{
+			name:   "cut",
+			kind:   TransitionCut,
+			events: []midiparse.NoteEvent{note(0, 1), note(1, 1)},
+			maxEnd: 2,
+			want:   []transitionSpan{{0, 1}, {0, 1}},
+		},
+		{
+			name:   "legato holds the outgoing note",
+			kind:   TransitionFade,
+			events: []midiparse.NoteEvent{note(0, 1), note(1, 1)},
+			maxEnd: 2,
+			want:   []transitionSpan{{0, 1.15}, {0.15, 1}},
+		},
+		{
+			name:   "clamped to the gap and the note length",
+			kind:   TransitionFade,
+			events: []midiparse.NoteEvent{note(0, 0.1), note(0.1, 0.05)},
+			maxEnd: 0.15,
+			want:   []transitionSpan{{0, 0.15}, {0.05, 0.05}},
+		},
+		{
+			name:   "a rest longer than the transition",
+			kind:   TransitionWipe,
+			events: []midiparse.NoteEvent{note(0, 0.5), note(1, 1)},
+			maxEnd: 2,
+			want:   []transitionSpan{{0, 0.5}, {0.15, 1}},
+		},
+		{
+			name:   "hold clamped to the segment end",
+			kind:   TransitionSlide,
+			events: []midiparse.NoteEvent{note(0, 1), note(1, 0.5)},
+			maxEnd: 1.1,
+			want:   []transitionSpan{{0, 1.1}, {0.15, 0.5}},
+		},
+		{
+			name:   "chord notes start together",
+			kind:   TransitionFade,
+			events: []midiparse.NoteEvent{note(0, 1), note(0, 1)},
+			maxEnd: 1,
+			want:   []transitionSpan{{0, 1}, {0, 1}},
+		},
+		{
+			name:   "held notes came in during the previous segment",
+			kind:   TransitionFade,
+			events: []midiparse.NoteEvent{note(-1, 2), note(-0.5, 2), note(0.5, 1)},
+			maxEnd: 2,
+			want:   []transitionSpan{{0, 2}, {0, 2}, {0.15, 1}},
+		},
+	}
+	for _, tt := range tests {
+		Transition = tt.kind
+		got := planTransitions(tt.events, tt.maxEnd)
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %d spans, want %d", tt.name, len(got), len(tt.want))
+		}
+		for i, w := range tt.want {
+			if math.Abs(got[i].in-w.in) > 1e-9 || math.Abs(got[i].show-w.show) > 1e-9 {
+				t.Errorf("%s: span %d = %+v, want %+v", tt.name, i, got[i], w)
+			}
+		}
+	}
+}
+
+func TestApplyTransition(t *testing.T) {
+	oldKind, oldProfile := Transition, OutputProfile
+	t.Cleanup(func() { Transition, OutputProfile = oldKind, oldProfile })
+	OutputProfile.Width, OutputProfile.Height = 4, 1
+
+	// One row of four opaque pixels, red 10, 20, 30, 40
+	src := []byte{10, 0, 0, 255, 20, 0, 0, 255, 30, 0, 0, 255, 40, 0, 0, 255}
+	tests := []struct {
+		kind TransitionKind
+		p    float64
+		want []byte
+	}{
+		{TransitionFade, 0.5, []byte{10, 0, 0, 127, 20, 0, 0, 127, 30, 0, 0, 127, 40, 0, 0, 127}},
+		{TransitionWipe, 0.5, []byte{10, 0, 0, 255, 20, 0, 0, 255, 30, 0, 0, 0, 40, 0, 0, 0}},
+		{TransitionSlide, 0.25, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 255}},
+		{TransitionSlide, 1, src},
+		{TransitionCut, 0.5, src},
+	}
+	for _, tt := range tests {
+		Transition = tt.kind
+		dst := make([]byte, len(src))
+		if got := applyTransition(dst, src, tt.p); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s at %.2f = %v, want %v", tt.kind, tt.p, got, tt.want)
+		}
+	}
+}
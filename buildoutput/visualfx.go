@@ -0,0 +1,326 @@
+package buildoutput
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+
+	"hello/ffgraph"
+	"hello/midiparse"
+)
+
+// VisualEffect is an effect triggered at note start on the note's layer.
+// Amount is scaled by the note's velocity; Decay is how long it takes to die away.
+type VisualEffect struct {
+	Type    string  `json:"type"`     // flash, zoom, shake, tint or mirror
+	Amount  float64 `json:"amount"`   // 0 uses the type's default
+	DecayMS float64 `json:"decay_ms"` // 0 uses 200ms
+}
+
+// VisualEffectsConfig selects effects for all tracks or per MIDI track.
+// A track entry replaces the default list for that track.
+type VisualEffectsConfig struct {
+	Default []VisualEffect            `json:"default"`
+	Tracks  map[string][]VisualEffect `json:"tracks"`
+
+	tracks map[int][]VisualEffect
+}
+
+// VisualEffects is the note effect configuration; empty means plain layers.
+var VisualEffects VisualEffectsConfig
+
+// visualEffectDefaults are the default amounts. mirror has none: it flips
+// every other take of a note.
+var visualEffectDefaults = map[string]float64{
+	"flash": 0.5,  // added brightness
+	"zoom":  0.15, // extra scale at note start
+	"shake": 0.02, // displacement as a fraction of the frame width
+	"tint":  0.5,  // how far the layer is blended toward its pitch-class colour, 0 to 1
+}
+
+// LoadVisualEffects reads and validates a visual effects config file.
+func LoadVisualEffects(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read visual effects: %w", err)
+	}
+	var cfg VisualEffectsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse visual effects %s: %w", path, err)
+	}
+
+	cfg.tracks = map[int][]VisualEffect{}
+	for key, list := range cfg.Tracks {
+		track, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("visual effects: track key %q is not a track number", key)
+		}
+		if err := validateVisualEffects(list); err != nil {
+			return fmt.Errorf("visual effects for track %d: %w", track, err)
+		}
+		cfg.tracks[track] = list
+	}
+	if err := validateVisualEffects(cfg.Default); err != nil {
+		return fmt.Errorf("default visual effects: %w", err)
+	}
+
+	VisualEffects = cfg
+	return nil
+}
+
+func validateVisualEffects(list []VisualEffect) error {
+	for i, fx := range list {
+		switch fx.Type {
+		case "flash", "zoom", "shake", "tint", "mirror":
+		default:
+			return fmt.Errorf("effect %d: unknown type %q", i, fx.Type)
+		}
+		if fx.Amount < 0 || fx.DecayMS < 0 {
+			return fmt.Errorf("effect %d: amount and decay_ms must not be negative", i)
+		}
+		if fx.Type == "tint" && fx.Amount > 1 {
+			return fmt.Errorf("effect %d: tint amount must be at most 1", i)
+		}
+	}
+	return nil
+}
+
+// forEvent returns the effects for an event's track.
+func (c VisualEffectsConfig) forEvent(e midiparse.NoteEvent) []VisualEffect {
+	if list, ok := c.tracks[e.Track]; ok {
+		return list
+	}
+	return c.Default
+}
+
+// takeKey identifies an event across batches by note and absolute start.
+type takeKey struct {
+	note    int
+	startMS int64
+}
+
+// takes numbers the occurrences of each note over the whole song, so mirror
+// alternates takes consistently even when the song is rendered in batches.
+var takes = map[takeKey]int{}
+
+// numberTakes fills takes for the sorted, absolute-time events of the song.
+func numberTakes(events []midiparse.NoteEvent) {
+	takes = map[takeKey]int{}
+	count := map[int]int{}
+	for _, e := range events {
+		takes[takeKey{e.Note, int64(math.Round(e.Start * 1000))}] = count[e.Note]
+		count[e.Note]++
+	}
+}
+
+func takeOf(e midiparse.NoteEvent, offset float64) int {
+	return takes[takeKey{e.Note, int64(math.Round((offset + e.Start) * 1000))}]
+}
+
+// velocityScale maps MIDI velocity to 0..1, treating a missing velocity as forte.
+func velocityScale(e midiparse.NoteEvent) float64 {
+	if e.Velocity <= 0 {
+		return 100.0 / 127
+	}
+	return float64(e.Velocity) / 127
+}
+
+// effectParams resolves amount (already scaled by velocity) and decay in seconds.
+func effectParams(fx VisualEffect, e midiparse.NoteEvent) (float64, float64) {
+	amount := fx.Amount
+	if amount == 0 {
+		amount = visualEffectDefaults[fx.Type]
+	}
+	decay := fx.DecayMS / 1000
+	if decay <= 0 {
+		decay = 0.2
+	}
+	return amount * velocityScale(e), decay
+}
+
+// pitchHue is the hue in degrees for a note's pitch class, C red round the wheel.
+func pitchHue(note int) float64 {
+	return float64(((note%12)+12)%12) * 30
+}
+
+// tintMatrix is the RGB colour matrix that blends each pixel toward its luma
+// in the note's pitch-class colour by amount (0 unchanged, 1 fully tinted).
+// Being linear, it is a single colorchannelmixer in the graph.
+func tintMatrix(note int, amount float64) [3][3]float64 {
+	// Fully saturated colour of the hue, 0 to 1 per channel
+	h := pitchHue(note) / 60
+	x := 1 - math.Abs(math.Mod(h, 2)-1)
+	var tint [3]float64
+	switch int(h) {
+	case 0:
+		tint = [3]float64{1, x, 0}
+	case 1:
+		tint = [3]float64{x, 1, 0}
+	case 2:
+		tint = [3]float64{0, 1, x}
+	case 3:
+		tint = [3]float64{0, x, 1}
+	case 4:
+		tint = [3]float64{x, 0, 1}
+	default:
+		tint = [3]float64{1, 0, x}
+	}
+
+	luma := [3]float64{0.299, 0.587, 0.114}
+	var m [3][3]float64
+	for out := range m {
+		for in := range m[out] {
+			m[out][in] = amount * tint[out] * luma[in]
+			if out == in {
+				m[out][in] += 1 - amount
+			}
+		}
+	}
+	return m
+}
+
+// visualEffectFilters returns the filters for an event's layer, applied while
+// the layer's timestamps still start at 0 so t is time since note start.
+func visualEffectFilters(e midiparse.NoteEvent, offset float64) []*ffgraph.Filter {
+	w, h := OutputProfile.Width, OutputProfile.Height
+	var filters []*ffgraph.Filter
+
+	for _, fx := range VisualEffects.forEvent(e) {
+		amount, decay := effectParams(fx, e)
+		env := fmt.Sprintf("max(0,1-t/%.3f)", decay)
+
+		switch fx.Type {
+		case "flash":
+			filters = append(filters, ffgraph.NewFilter("eq").
+				Setf("brightness", "%.3f*%s", amount, env).
+				Set("eval", "frame"))
+		case "zoom":
+			filters = append(filters,
+				ffgraph.NewFilter("scale").
+					Setf("w", "trunc(%d*(1+%.3f*%s)/2)*2", w, amount, env).
+					Setf("h", "trunc(%d*(1+%.3f*%s)/2)*2", h, amount, env).
+					Set("eval", "frame"),
+				ffgraph.NewFilter("crop").Argf("%d", w).Argf("%d", h))
+		case "shake":
+			margin := int(math.Ceil(amount*float64(w))) * 2
+			filters = append(filters,
+				ffgraph.NewFilter("crop").
+					Argf("%d", w-margin).Argf("%d", h-margin).
+					Argf("%d+%d*sin(t*83)*%s", margin/2, margin/2, env).
+					Argf("%d+%d*cos(t*97)*%s", margin/2, margin/2, env),
+				ffgraph.NewFilter("scale").Argf("%d", w).Argf("%d", h))
+		case "tint":
+			m := tintMatrix(e.Note, math.Min(1, amount))
+			mixer := ffgraph.NewFilter("colorchannelmixer")
+			for out, o := range "rgb" {
+				for in, i := range "rgb" {
+					mixer.Setf(string(o)+string(i), "%.4f", m[out][in])
+				}
+			}
+			filters = append(filters, mixer)
+		case "mirror":
+			if takeOf(e, offset)%2 == 1 {
+				filters = append(filters, ffgraph.NewFilter("hflip"))
+			}
+		}
+	}
+	return filters
+}
+
+// applyVisualEffects is the compositor version of visualEffectFilters: it
+// renders src (an RGBA frame) with the event's effects into dst at time t
+// since note start and returns the frame to draw. src is never modified;
+// dst and scratch are frame-sized buffers reused across calls.
+func applyVisualEffects(dst, scratch, src []byte, e midiparse.NoteEvent, t float64) []byte {
+	list := VisualEffects.forEvent(e)
+	if len(list) == 0 {
+		return src
+	}
+	w, h := OutputProfile.Width, OutputProfile.Height
+	copy(dst, src)
+
+	for _, fx := range list {
+		amount, decay := effectParams(fx, e)
+		env := math.Max(0, 1-t/decay)
+
+		switch fx.Type {
+		case "flash":
+			add := amount * env * 255
+			for i := 0; i < len(dst); i += 4 {
+				for c := 0; c < 3; c++ {
+					dst[i+c] = clampByte(float64(dst[i+c]) + add)
+				}
+			}
+		case "zoom", "shake":
+			zoom := 1.0
+			dx, dy := 0.0, 0.0
+			if fx.Type == "zoom" {
+				zoom = 1 + amount*env
+			} else {
+				m := amount * float64(w)
+				zoom = float64(w) / (float64(w) - 2*m)
+				dx, dy = m*math.Sin(t*83)*env, m*math.Cos(t*97)*env
+			}
+			copy(scratch, dst)
+			transformFrame(dst, scratch, w, h, zoom, dx, dy, false)
+		case "tint":
+			mixColors(dst, tintMatrix(e.Note, math.Min(1, amount)))
+		case "mirror":
+			if takeOf(e, 0)%2 == 1 {
+				copy(scratch, dst)
+				transformFrame(dst, scratch, w, h, 1, 0, 0, true)
+			}
+		}
+	}
+	return dst
+}
+
+// transformFrame samples src scaled about the centre by zoom, shifted by
+// (dx, dy) pixels and optionally mirrored, nearest neighbour.
+func transformFrame(dst, src []byte, w, h int, zoom, dx, dy float64, mirror bool) {
+	cx, cy := float64(w)/2, float64(h)/2
+	for y := 0; y < h; y++ {
+		sy := int((float64(y)-cy)/zoom + cy + dy)
+		if sy < 0 {
+			sy = 0
+		} else if sy >= h {
+			sy = h - 1
+		}
+		for x := 0; x < w; x++ {
+			ox := x
+			if mirror {
+				ox = w - 1 - x
+			}
+			sx := int((float64(ox)-cx)/zoom + cx + dx)
+			if sx < 0 {
+				sx = 0
+			} else if sx >= w {
+				sx = w - 1
+			}
+			copy(dst[(y*w+x)*4:(y*w+x)*4+4], src[(sy*w+sx)*4:(sy*w+sx)*4+4])
+		}
+	}
+}
+
+// mixColors applies an RGB colour matrix to an RGBA frame, like ffmpeg's
+// colorchannelmixer.
+func mixColors(frame []byte, m [3][3]float64) {
+	for i := 0; i < len(frame); i += 4 {
+		r, g, b := float64(frame[i]), float64(frame[i+1]), float64(frame[i+2])
+		for c := 0; c < 3; c++ {
+			frame[i+c] = clampByte(m[c][0]*r + m[c][1]*g + m[c][2]*b)
+		}
+	}
+}
+
+func clampByte(v float64) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
@@ -0,0 +1,24 @@
+package buildoutput
+
+import "testing"
+
+func TestTintMatrix(t *testing.T) {
+	grey := func(m [3][3]float64) []byte {
+		px := []byte{128, 128, 128, 255}
+		mixColors(px, m)
+		return px
+	}
+
+	if px := grey(tintMatrix(0, 0)); px[0] != 128 || px[1] != 128 || px[2] != 128 {
+		t.Errorf("amount 0 changed grey to %v", px)
+	}
+	// C is red, E (4) is green and G# (8) is blue at full tint
+	for note, ch := range map[int]int{60: 0, 64: 1, 68: 2} {
+		px := grey(tintMatrix(note, 1))
+		for c := 0; c < 3; c++ {
+			if c != ch && px[c] >= px[ch] {
+				t.Errorf("note %d: channel %d not dominant in %v", note, ch, px)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package cmdrun
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Result holds everything an external command wrote while it ran.
+type Result struct {
+	Stdout []byte
+	Stderr []byte
+}
+
+// Combined returns stdout followed by stderr, for callers that used to rely on
+// exec.Cmd.CombinedOutput (ffmpeg prints its analysis results on stderr).
+func (r Result) Combined() []byte {
+	out := make([]byte, 0, len(r.Stdout)+len(r.Stderr))
+	out = append(out, r.Stdout...)
+	return append(out, r.Stderr...)
+}
+
+// Runner runs an external tool (ffmpeg, sox, aubio...) and captures its output.
+// RunInput is the same but feeds stdin, e.g. raw frames piped into an encoder.
+// RunOutput streams stdout to a writer instead of capturing it, for outputs
+// too large to hold in memory such as decoded raw frames.
+type Runner interface {
+	Run(ctx context.Context, name string, args ...string) (Result, error)
+	RunInput(ctx context.Context, stdin io.Reader, name string, args ...string) (Result, error)
+	RunOutput(ctx context.Context, stdout io.Writer, name string, args ...string) (Result, error)
+}
+
+// Exec is the real Runner backed by os/exec. Output is always captured; if
+// Stdout/Stderr are set it is also streamed there so ffmpeg progress stays visible.
+type Exec struct {
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func (e Exec) Run(ctx context.Context, name string, args ...string) (Result, error) {
+	return e.RunInput(ctx, nil, name, args...)
+}
+
+func (e Exec) RunInput(ctx context.Context, stdin io.Reader, name string, args ...string) (Result, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if e.Stdout != nil {
+		cmd.Stdout = io.MultiWriter(&stdout, e.Stdout)
+	}
+	if e.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, e.Stderr)
+	}
+
+	err := cmd.Run()
+	return Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}, err
+}
+
+// RunOutput writes stdout only to w; the Result holds stderr alone.
+func (e Exec) RunOutput(ctx context.Context, w io.Writer, name string, args ...string) (Result, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if e.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, e.Stderr)
+	}
+
+	err := cmd.Run()
+	return Result{Stderr: stderr.Bytes()}, err
+}
+
+// Default streams tool output to the terminal, matching the old behaviour.
+var Default Runner = Exec{Stdout: os.Stdout, Stderr: os.Stderr}
+
+// Silenced returns r with terminal echo turned off, for commands whose output
+// is parsed rather than shown (ffmpeg volumedetect, aubiopitch). Fakes are
+// returned unchanged so they still record the call.
+func Silenced(r Runner) Runner {
+	if _, ok := r.(Exec); ok {
+		return Exec{}
+	}
+	return r
+}
+
+// Call is one recorded invocation.
+type Call struct {
+	Name string
+	Args []string
+}
+
+// String renders the call as a single shell-like line, suitable for golden files.
+func (c Call) String() string {
+	parts := []string{c.Name}
+	for _, a := range c.Args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\";|&[]()$*?") {
+			a = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+		parts = append(parts, a)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Recorder is a fake Runner that records every call instead of executing it.
+// Respond, if set, supplies the canned output for a call (e.g. aubionotes lines
+// or an ffmpeg volumedetect report).
+type Recorder struct {
+	Respond func(c Call) (Result, error)
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+func (r *Recorder) Run(ctx context.Context, name string, args ...string) (Result, error) {
+	return r.RunInput(ctx, nil, name, args...)
+}
+
+// RunInput records the call and drains stdin so the writer on the other end
+// of a pipe is never left blocked.
+func (r *Recorder) RunInput(ctx context.Context, stdin io.Reader, name string, args ...string) (Result, error) {
+	if stdin != nil {
+		if _, err := io.Copy(io.Discard, stdin); err != nil {
+			return Result{}, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	c := Call{Name: name, Args: append([]string(nil), args...)}
+
+	r.mu.Lock()
+	r.calls = append(r.calls, c)
+	r.mu.Unlock()
+
+	if r.Respond != nil {
+		return r.Respond(c)
+	}
+	return Result{}, nil
+}
+
+// RunOutput records the call and writes the canned stdout to w.
+func (r *Recorder) RunOutput(ctx context.Context, w io.Writer, name string, args ...string) (Result, error) {
+	res, err := r.RunInput(ctx, nil, name, args...)
+	if len(res.Stdout) > 0 {
+		if _, werr := w.Write(res.Stdout); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return Result{Stderr: res.Stderr}, err
+}
+
+// Calls returns a copy of the recorded calls in the order they were made.
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// Transcript returns the recorded calls one per line, for golden comparisons.
+func (r *Recorder) Transcript() string {
+	var b strings.Builder
+	for _, c := range r.Calls() {
+		fmt.Fprintln(&b, c.String())
+	}
+	return b.String()
+}
@@ -0,0 +1,343 @@
+package ffgraph
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Pad is a link label in a filtergraph, e.g. [0:v], [v3] or [vout].
+type Pad struct {
+	label string
+	input bool // stream specifier of an -i input rather than a filter output
+	index int  // input index when input is true
+}
+
+// String renders the pad with its brackets.
+func (p Pad) String() string {
+	return "[" + p.label + "]"
+}
+
+// Filter is a single filter with its arguments, e.g. scale=1920:1080:flags=lanczos.
+type Filter struct {
+	Name string
+	args []string // already rendered "value" or "key=value"
+}
+
+// NewFilter starts a filter with the given name and no arguments.
+func NewFilter(name string) *Filter {
+	return &Filter{Name: name}
+}
+
+// Arg appends a positional argument. The value is escaped as one option
+// value, so a ':' inside it is literal: pass 1920 and 1080 as two Args, or
+// use Raw for a ready-made list such as "1920:1080".
+func (f *Filter) Arg(value string) *Filter {
+	f.args = append(f.args, escapeValue(value))
+	return f
+}
+
+// Raw appends arguments verbatim, without escaping. The caller is responsible
+// for escaping anything the option or graph parser would otherwise split on.
+func (f *Filter) Raw(args string) *Filter {
+	f.args = append(f.args, args)
+	return f
+}
+
+// Argf appends a formatted positional argument.
+func (f *Filter) Argf(format string, a ...any) *Filter {
+	return f.Arg(fmt.Sprintf(format, a...))
+}
+
+// Set appends a key=value option.
+func (f *Filter) Set(key, value string) *Filter {
+	f.args = append(f.args, key+"="+escapeValue(value))
+	return f
+}
+
+// Setf appends a key=value option with a formatted value.
+func (f *Filter) Setf(key, format string, a ...any) *Filter {
+	return f.Set(key, fmt.Sprintf(format, a...))
+}
+
+// String renders the filter as it appears inside a chain.
+func (f *Filter) String() string {
+	if len(f.args) == 0 {
+		return f.Name
+	}
+	return f.Name + "=" + strings.Join(f.args, ":")
+}
+
+// Chain is a comma separated run of filters with labelled inputs and outputs.
+type Chain struct {
+	In      []Pad
+	Filters []*Filter
+	Out     []Pad
+}
+
+func (c *Chain) String() string {
+	var b strings.Builder
+	for _, p := range c.In {
+		b.WriteString(p.String())
+	}
+	for i, f := range c.Filters {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(f.String())
+	}
+	for _, p := range c.Out {
+		b.WriteString(p.String())
+	}
+	return b.String()
+}
+
+// Graph collects the -i inputs and filter chains of one ffmpeg invocation and
+// hands out unique labels, so callers never format [v%d] strings by hand.
+type Graph struct {
+	inputs  []input
+	chains  []*Chain
+	outputs []Pad
+	used    map[string]bool
+	seq     map[string]int
+}
+
+// input is one -i file with the options that must precede it.
+type input struct {
+	path string
+	opts []string
+}
+
+// New returns an empty graph.
+func New() *Graph {
+	return &Graph{used: map[string]bool{}, seq: map[string]int{}}
+}
+
+// AddInput registers an input file and returns its input index.
+func (g *Graph) AddInput(path string) int {
+	return g.AddInputWithOptions(path)
+}
+
+// AddInputWithOptions registers an input preceded by input options, e.g.
+// AddInputWithOptions("-", "-f", "f32le", "-ac", "2") for raw audio on stdin.
+func (g *Graph) AddInputWithOptions(path string, opts ...string) int {
+	g.inputs = append(g.inputs, input{path: path, opts: opts})
+	return len(g.inputs) - 1
+}
+
+// Inputs returns the registered input files in index order.
+func (g *Graph) Inputs() []string {
+	paths := make([]string, len(g.inputs))
+	for i, in := range g.inputs {
+		paths[i] = in.path
+	}
+	return paths
+}
+
+// InputArgs returns the "[options] -i <file>" arguments for every registered input.
+func (g *Graph) InputArgs() []string {
+	var args []string
+	for _, in := range g.inputs {
+		args = append(args, in.opts...)
+		args = append(args, "-i", in.path)
+	}
+	return args
+}
+
+// Stream returns the pad for a stream of an input, e.g. Stream(2, "a") is [2:a].
+func (g *Graph) Stream(index int, stream string) Pad {
+	return Pad{label: fmt.Sprintf("%d:%s", index, stream), input: true, index: index}
+}
+
+// Label returns a fresh label with the given prefix: v0, v1, ...
+func (g *Graph) Label(prefix string) Pad {
+	for {
+		name := fmt.Sprintf("%s%d", prefix, g.seq[prefix])
+		g.seq[prefix]++
+		if !g.used[name] {
+			g.used[name] = true
+			return Pad{label: name}
+		}
+	}
+}
+
+// Named returns a label with a fixed name such as "vout". Naming the same pad
+// twice is reported by Validate.
+func (g *Graph) Named(name string) Pad {
+	g.used[name] = true
+	return Pad{label: name}
+}
+
+// Chain appends a filter chain reading from in and writing to out.
+func (g *Graph) Chain(in []Pad, out []Pad, filters ...*Filter) {
+	g.chains = append(g.chains, &Chain{In: in, Filters: filters, Out: out})
+}
+
+// Apply is a shortcut for a single-input, single-output chain that returns a
+// fresh output pad with the given prefix.
+func (g *Graph) Apply(in Pad, prefix string, filters ...*Filter) Pad {
+	out := g.Label(prefix)
+	g.Chain([]Pad{in}, []Pad{out}, filters...)
+	return out
+}
+
+// Combine is Apply for multi-input filters such as overlay or amix.
+func (g *Graph) Combine(in []Pad, prefix string, filters ...*Filter) Pad {
+	out := g.Label(prefix)
+	g.Chain(in, []Pad{out}, filters...)
+	return out
+}
+
+// Source appends a chain with no inputs (color, anullsrc...) and returns its output pad.
+func (g *Graph) Source(prefix string, filters ...*Filter) Pad {
+	out := g.Label(prefix)
+	g.Chain(nil, []Pad{out}, filters...)
+	return out
+}
+
+// Split fans one video pad out to n pads with the split filter, so a single
+// decoded stream can feed several chains. n == 1 returns in unchanged.
+func (g *Graph) Split(in Pad, n int, prefix string) []Pad {
+	return g.fanout("split", in, n, prefix)
+}
+
+// ASplit is Split for audio pads (asplit).
+func (g *Graph) ASplit(in Pad, n int, prefix string) []Pad {
+	return g.fanout("asplit", in, n, prefix)
+}
+
+func (g *Graph) fanout(filter string, in Pad, n int, prefix string) []Pad {
+	if n <= 1 {
+		return []Pad{in}
+	}
+	outs := make([]Pad, n)
+	for i := range outs {
+		outs[i] = g.Label(prefix)
+	}
+	g.Chain([]Pad{in}, outs, NewFilter(filter).Argf("%d", n))
+	return outs
+}
+
+// Output marks a pad as a graph output that will be selected with -map.
+func (g *Graph) Output(p Pad) {
+	g.outputs = append(g.outputs, p)
+}
+
+// MapArgs returns the "-map [label]" arguments for every output pad.
+func (g *Graph) MapArgs() []string {
+	var args []string
+	for _, p := range g.outputs {
+		args = append(args, "-map", p.String())
+	}
+	return args
+}
+
+// Chains returns the chains in the order they were added.
+func (g *Graph) Chains() []*Chain {
+	return g.chains
+}
+
+// String renders the full -filter_complex value.
+func (g *Graph) String() string {
+	return g.join(";")
+}
+
+// Script renders the graph one chain per line, the format read by
+// -filter_complex_script. Newlines are whitespace to the graph parser.
+func (g *Graph) Script() string {
+	return g.join(";\n") + "\n"
+}
+
+func (g *Graph) join(sep string) string {
+	parts := make([]string, len(g.chains))
+	for i, c := range g.chains {
+		parts[i] = c.String()
+	}
+	return strings.Join(parts, sep)
+}
+
+// WriteScript writes the graph to path and returns the ffmpeg arguments that
+// load it, keeping large graphs off the command line.
+func (g *Graph) WriteScript(path string) ([]string, error) {
+	if err := os.WriteFile(path, []byte(g.Script()), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write filter script: %w", err)
+	}
+	return []string{"-filter_complex_script", path}, nil
+}
+
+// Validate checks the wiring without running ffmpeg: every input pad refers
+// to a registered input, every filter output is produced once and consumed
+// exactly once (either by another chain or by -map), and no chain is empty.
+func (g *Graph) Validate() error {
+	produced := map[string]int{}
+	consumed := map[string]int{}
+
+	for i, c := range g.chains {
+		if len(c.Filters) == 0 {
+			return fmt.Errorf("chain %d has no filters", i)
+		}
+		for _, f := range c.Filters {
+			if f.Name == "" {
+				return fmt.Errorf("chain %d has a filter without a name", i)
+			}
+		}
+		for _, p := range c.In {
+			if p.input {
+				if p.index < 0 || p.index >= len(g.inputs) {
+					return fmt.Errorf("chain %d reads %s but only %d inputs are registered", i, p, len(g.inputs))
+				}
+				continue
+			}
+			consumed[p.label]++
+		}
+		for _, p := range c.Out {
+			if p.input {
+				return fmt.Errorf("chain %d writes to input pad %s", i, p)
+			}
+			produced[p.label]++
+		}
+	}
+	for _, p := range g.outputs {
+		consumed[p.label]++
+	}
+
+	for label, n := range produced {
+		if n > 1 {
+			return fmt.Errorf("pad [%s] is produced %d times", label, n)
+		}
+		if consumed[label] == 0 {
+			return fmt.Errorf("pad [%s] is never consumed", label)
+		}
+		if consumed[label] > 1 {
+			return fmt.Errorf("pad [%s] is consumed %d times; use split/asplit", label, consumed[label])
+		}
+	}
+	for label := range consumed {
+		if produced[label] == 0 {
+			return fmt.Errorf("pad [%s] is consumed but never produced", label)
+		}
+	}
+	return nil
+}
+
+// escapeValue applies both levels of ffmpeg filtergraph escaping to an
+// argument: first for the option parser (\ ' :), then for the graph parser
+// (\ ' [ ] , ;). Plain values such as "1920" or "(ow-iw)/2" pass through unchanged.
+func escapeValue(v string) string {
+	v = escapeChars(v, `\':`)
+	return escapeChars(v, `\'[],;`)
+}
+
+func escapeChars(v, special string) string {
+	if !strings.ContainsAny(v, special) {
+		return v
+	}
+	var b strings.Builder
+	for _, r := range v {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package ffgraph
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscapeValue(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1920", "1920"},
+		{"(ow-iw)/2", "(ow-iw)/2"},
+		{"PTS+1.500/TB", "PTS+1.500/TB"},
+		{"a:b", `a\\:b`},
+		{"between(t,1,2)", `between(t\,1\,2)`},
+		{"it's", `it\\\'s`},
+		{`C:\fonts`, `C\\:\\\\fonts`},
+		{"[x];y", `\[x\]\;y`},
+	}
+	for _, tt := range tests {
+		if got := escapeValue(tt.in); got != tt.want {
+			t.Errorf("escapeValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFilterString(t *testing.T) {
+	tests := []struct {
+		f    *Filter
+		want string
+	}{
+		{NewFilter("hflip"), "hflip"},
+		{NewFilter("scale").Arg("1920").Arg("1080").Set("flags", "lanczos"), "scale=1920:1080:flags=lanczos"},
+		{NewFilter("scale").Raw("1920:1080"), "scale=1920:1080"},
+		{NewFilter("scale").Arg("1920:1080"), `scale=1920\\:1080`},
+		{NewFilter("drawtext").Set("text", "Don't stop"), `drawtext=text=Don\\\'t stop`},
+		{NewFilter("volume").Setf("enable", "between(t,%.1f,%.1f)", 0.5, 1.0), `volume=enable=between(t\,0.5\,1.0)`},
+	}
+	for _, tt := range tests {
+		if got := tt.f.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestGraphWiring(t *testing.T) {
+	g := New()
+	in := g.AddInput("clip.mp4")
+	scaled := g.Apply(g.Stream(in, "v"), "s", NewFilter("scale").Arg("640").Arg("360"))
+	branches := g.Split(scaled, 2, "sv")
+	bg := g.Source("bg", NewFilter("color").Set("c", "black"))
+	out := g.Named("vout")
+	tmp := g.Combine([]Pad{bg, branches[0]}, "tmp", NewFilter("overlay"))
+	g.Chain([]Pad{tmp, branches[1]}, []Pad{out}, NewFilter("overlay"))
+	g.Output(out)
+
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := "[0:v]scale=640:360[s0];" +
+		"[s0]split=2[sv0][sv1];" +
+		"color=c=black[bg0];" +
+		"[bg0][sv0]overlay[tmp0];" +
+		"[tmp0][sv1]overlay[vout]"
+	if got := g.String(); got != want {
+		t.Errorf("graph:\n got %s\nwant %s", got, want)
+	}
+	if got := strings.Join(g.MapArgs(), " "); got != "-map [vout]" {
+		t.Errorf("map args = %q", got)
+	}
+	if got := strings.Join(g.InputArgs(), " "); got != "-i clip.mp4" {
+		t.Errorf("input args = %q", got)
+	}
+}
+
+func TestSplitOfOne(t *testing.T) {
+	g := New()
+	p := g.Stream(g.AddInput("a.mp4"), "a")
+	if pads := g.ASplit(p, 1, "sa"); len(pads) != 1 || pads[0] != p || len(g.Chains()) != 0 {
+		t.Errorf("ASplit of one = %v with %d chains, want the input pad and no chain", pads, len(g.Chains()))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(g *Graph)
+		err   string
+	}{
+		{"missing input", func(g *Graph) {
+			g.Output(g.Apply(g.Stream(3, "v"), "v", NewFilter("null")))
+		}, "only 0 inputs"},
+		{"unconsumed", func(g *Graph) {
+			g.Source("bg", NewFilter("color"))
+		}, "never consumed"},
+		{"consumed twice", func(g *Graph) {
+			bg := g.Source("bg", NewFilter("color"))
+			g.Output(g.Apply(bg, "a", NewFilter("null")))
+			g.Output(g.Apply(bg, "b", NewFilter("null")))
+		}, "consumed 2 times"},
+		{"produced twice", func(g *Graph) {
+			out := g.Named("vout")
+			g.Chain(nil, []Pad{out}, NewFilter("color"))
+			g.Chain(nil, []Pad{out}, NewFilter("color"))
+			g.Output(out)
+		}, "produced 2 times"},
+		{"never produced", func(g *Graph) {
+			g.Output(g.Named("vout"))
+		}, "never produced"},
+		{"empty chain", func(g *Graph) {
+			g.Chain(nil, []Pad{g.Label("x")})
+		}, "no filters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := New()
+			tt.build(g)
+			err := g.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Validate() = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
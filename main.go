@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	// "hello/buildoutput"
 	"hello/audiopack"
 	"hello/buildoutput"
+	"hello/cmdrun"
 	"hello/midiparse"
+	"hello/profile"
 )
 
+// runner executes the ffmpeg clip extraction in splitVideoSegments.
+var runner cmdrun.Runner = cmdrun.Default
+
+// outputProfile is the render profile selected with -profile/-config; clips
+// are extracted with the same encoder settings as the final render.
+var outputProfile = profile.Default()
+
 func ensureDir(dir string) error {
 	return os.MkdirAll(dir, os.ModePerm)
 }
@@ -36,8 +51,7 @@ func splitVideoSegments(videoPath string, segments []audiopack.NoteSegment, outp
 			return nil, fmt.Errorf("audio file not found: %s", audioFile)
 		}
 
-		cmd := exec.Command(
-			"ffmpeg",
+		args := []string{
 			"-y",
 			"-ss", fmt.Sprintf("%.3f", seg.Start),
 			"-to", fmt.Sprintf("%.3f", seg.End),
@@ -45,17 +59,17 @@ func splitVideoSegments(videoPath string, segments []audiopack.NoteSegment, outp
 			"-i", audioFile,
 			"-map", "0:v:0", // Video from first input (original video)
 			"-map", "1:a:0", // Audio from second input (pitch-corrected audio)
-			"-c:v", "libx264",
-			"-c:a", "aac",
+		}
+		args = append(args, outputProfile.VideoArgs()...)
+		args = append(args, outputProfile.AudioArgs()...)
+		args = append(args,
 			"-shortest", // End when shortest stream ends
 			outFile,
 		)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
 
 		fmt.Printf("Creating video clip %s (%.3f - %.3f) with audio from %s\n",
 			outFile, seg.Start, seg.End, audioFile)
-		if err := cmd.Run(); err != nil {
+		if _, err := runner.Run(context.Background(), "ffmpeg", args...); err != nil {
 			return nil, fmt.Errorf("ffmpeg split failed: %w", err)
 		}
 		clipPaths = append(clipPaths, outFile)
@@ -63,14 +77,296 @@ func splitVideoSegments(videoPath string, segments []audiopack.NoteSegment, outp
 	return clipPaths, nil
 }
 
+// splitHits cuts each detected hit out of the video with its original audio.
+// The drum kit plays clips named after their sound, so the n-th hit is saved
+// as outputDir/<names[n]>.mp4 (kick.mp4, snare.mp4, ...); hits past the end
+// of names are saved as hit_NNN.mp4 and must be renamed by hand to be used.
+func splitHits(videoPath string, hits []audiopack.NoteSegment, names []string, outputDir string) error {
+	if err := ensureDir(outputDir); err != nil {
+		return err
+	}
+	for _, hit := range hits {
+		outFile := filepath.Join(outputDir, fmt.Sprintf("hit_%03d.mp4", hit.Note))
+		if hit.Note < len(names) && names[hit.Note] != "" {
+			outFile = filepath.Join(outputDir, names[hit.Note]+".mp4")
+		}
+		args := []string{
+			"-y",
+			"-ss", fmt.Sprintf("%.3f", hit.Start),
+			"-to", fmt.Sprintf("%.3f", hit.End),
+			"-i", videoPath,
+		}
+		args = append(args, outputProfile.VideoArgs()...)
+		args = append(args, outputProfile.AudioArgs()...)
+		args = append(args, outFile)
+
+		fmt.Printf("Creating hit clip %s (%.3f - %.3f)\n", outFile, hit.Start, hit.End)
+		if _, err := runner.Run(context.Background(), "ffmpeg", args...); err != nil {
+			return fmt.Errorf("ffmpeg split failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// transcribeVideo runs the analysis stage on a video and writes the detected
+// note segments, after the same volume filtering used for clips, to a MIDI file.
+func transcribeVideo(videoPath, midiPath string, bpm float64) error {
+	audioPath := "audio.wav"
+	if err := audiopack.ExtractAudio(videoPath, audioPath); err != nil {
+		return fmt.Errorf("extracting audio: %w", err)
+	}
+	lines, err := audiopack.RunAubioNotes(audioPath)
+	if err != nil {
+		return fmt.Errorf("running aubionotes: %w", err)
+	}
+	segments := audiopack.FilterAudioSegments(audiopack.ParseAubioOutput(lines), videoPath, 1.3)
+	if key, r, err := audiopack.DetectKey(segments); err == nil {
+		fmt.Printf("Detected key: %s (correlation %.2f)\n", key, r)
+	}
+	segments = audiopack.SnapSegments(segments)
+	return audiopack.ExportMIDI(segments, midiPath, bpm)
+}
+
+// recordPerformance records a MIDI input port, or replays a MIDI file in real
+// time when replay is set, to midiPath. With preview each note-on plays its
+// clip as it comes in. A port is recorded until Ctrl+C.
+func recordPerformance(midiPath, port, replay string, bpm float64, preview bool) error {
+	rec, err := midiparse.NewRecording(bpm)
+	if err != nil {
+		return err
+	}
+	if preview {
+		player, err := buildoutput.StartPreview(context.Background())
+		if err != nil {
+			return fmt.Errorf("starting preview: %w", err)
+		}
+		defer player.Close()
+		rec.OnNote = func(channel, key, velocity uint8) {
+			player.Note(int(channel), int(key), int(velocity))
+		}
+	}
+
+	if replay != "" {
+		fmt.Printf("Replaying %s\n", replay)
+		if err := midiparse.ReplayFile(replay, rec, preview); err != nil {
+			return err
+		}
+		return rec.WriteFile(midiPath)
+	}
+
+	stop, err := midiparse.ListenPort(port, rec)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Recording, press Ctrl+C to stop")
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+	stop()
+	return rec.WriteFile(midiPath)
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatalf("Usage: go run main.go <video-file> <midi-file>")
+	backend := flag.String("backend", string(buildoutput.BackendFFmpeg), "render backend: ffmpeg or compositor")
+	profileName := flag.String("profile", "1080p30", fmt.Sprintf("render profile %v", profile.Names()))
+	configPath := flag.String("config", "", "JSON file overriding fields of the render profile")
+	crop := flag.String("crop", string(buildoutput.CropFit), "how clips fill the frame: fit, center, manual or auto")
+	cropBoxes := flag.String("crop-boxes", "", "JSON file of clip path to crop box, for -crop manual")
+	backgrounds := flag.String("backgrounds", "", "JSON file of background sections (color, gradient, image, video)")
+	backingPath := flag.String("backing", "", "backing track (WAV/MP3) mixed under the notes")
+	backingOffset := flag.Float64("backing-offset", 0, "song time in seconds the backing track starts at")
+	backingGain := flag.Float64("backing-gain", 0, "backing track gain in dB")
+	duck := flag.Bool("duck", false, "duck the backing track while notes sound")
+	voiceGain := flag.Float64("voice-gain", buildoutput.Mix.VoiceGainDB, "gain of every note voice in dB")
+	loudness := flag.Float64("loudness", buildoutput.Mix.LoudnessLUFS, "output loudness target in LUFS (0 disables)")
+	effects := flag.String("effects", "", "JSON file of per-track and global audio effects (reverb, eq, delay)")
+	visualFX := flag.String("visual-fx", "", "JSON file of note-on visual effects (flash, zoom, shake, tint, mirror)")
+	transition := flag.String("transition", string(buildoutput.TransitionCut), "transition between notes: cut, fade, wipe or slide")
+	transitionDuration := flag.Float64("transition-duration", buildoutput.TransitionDuration, "longest transition in seconds, clamped to the gap between notes")
+	noteNames := flag.Bool("note-names", false, "draw the names of the sounding notes")
+	lyrics := flag.Bool("lyrics", false, "draw MIDI lyrics as karaoke text")
+	pianoRoll := flag.Bool("piano-roll", false, "draw a scrolling piano roll along the bottom")
+	font := flag.String("font", "", "font file for text overlays (default: fontconfig)")
+	quantize := flag.Int("quantize", 0, "quantize note starts to a grid note value, e.g. 16 for sixteenths (0 disables)")
+	quantizeStrength := flag.Float64("quantize-strength", 1, "how far notes move toward the grid, 0 to 1")
+	swing := flag.Float64("swing", 0, "swing of the quantize grid, 0 straight to 1 triplet feel")
+	tempoScale := flag.Float64("tempo-scale", 1, "playback speed, e.g. 1.1 for 10% faster")
+	bars := flag.String("bars", "", "bar range to render, e.g. 17-32")
+	transpose := flag.String("transpose", "", "transpose notes: a number of semitones, \"suggest\" to report the best fit to the clip library, or \"auto\" to apply it")
+	fitTracks := flag.Bool("fit-tracks", false, "with -transpose suggest/auto, also shift tracks by octaves")
+	arpeggio := flag.String("arpeggio", "", "break chords into arpeggios: up, down, updown or random")
+	arpeggioStep := flag.Float64("arpeggio-step", 0.125, "seconds between arpeggio notes")
+	harmony := flag.Int("harmony", 0, "add a diatonic harmony this many scale steps away, e.g. 2 for a third above, -5 for a sixth below")
+	key := flag.String("key", "C", "key for -harmony, e.g. G, F#m or Bb minor")
+	maxVoices := flag.Int("max-voices", 0, "limit how many notes sound at once (0 for no limit)")
+	steal := flag.String("steal", "oldest", "voice stealing rule for -max-voices: oldest, lowest or quietest")
+	pan := flag.String("pan", string(buildoutput.PanCenter), "note panning: center, cc10, pitch or layout")
+	panWidth := flag.Float64("pan-width", buildoutput.PanWidth, "stereo width of note panning, 0 to 1")
+	melodyFrom := flag.String("melody-from", "", "transcribe the melody of this reference audio instead of reading a score")
+	melodyBPM := flag.Float64("melody-bpm", 0, "tempo for quantizing the transcribed melody (0 disables)")
+	minNote := flag.Float64("min-note", audiopack.DefaultMelodyOptions.MinNoteLength, "shortest transcribed melody note in seconds")
+	transcribe := flag.String("transcribe", "", "only transcribe the video's singing to this MIDI file, then exit")
+	transcribeBPM := flag.Float64("transcribe-bpm", 120, "tempo written to the -transcribe MIDI file")
+	drums := flag.Bool("drums", false, "play MIDI channel 10 from the drum kit in temp_drums instead of pitched clips")
+	drumKit := flag.String("drum-kit", "", "JSON drum kit mapping GM drum keys to clip names (implies -drums)")
+	extractHits := flag.Bool("extract-hits", false, "only cut the video's percussive hits into temp_drums for a drum kit, then exit")
+	hitNames := flag.String("hit-names", "", "comma-separated kit names for the extracted hits in order, e.g. kick,snare,clap; unnamed hits are saved as hit_NNN.mp4 to rename by hand")
+	record := flag.String("record", "", "record a performance from a MIDI input to this MIDI file until Ctrl+C, then exit")
+	recordPort := flag.String("record-port", "", "MIDI input port to record from (default: the first port)")
+	recordReplay := flag.String("record-replay", "", "with -record, replay this MIDI file as the input instead of a port")
+	recordBPM := flag.Float64("record-bpm", 120, "tempo written to the -record MIDI file")
+	preview := flag.Bool("preview", false, "with -record, play each note's library clip as it is played")
+	snapScale := flag.Bool("snap-scale", false, "correct out-of-key notes to the nearest in-key note; only affects -transcribe")
+	scaleKey := flag.String("scale-key", "", "key for -snap-scale, e.g. G or F#m (default: detected from the notes)")
+	batchSize := flag.Int("batch-size", buildoutput.MaxEventsPerBatch, "note events per ffmpeg pass before the render is split into segments (the default is unmeasured)")
+	flag.Parse()
+
+	audiopack.SnapToScale = *snapScale
+	if *scaleKey != "" {
+		k, err := midiparse.ParseKey(*scaleKey)
+		if err != nil {
+			log.Fatalf("Error parsing scale key: %v", err)
+		}
+		audiopack.ScaleKey = &k
+	}
+
+	switch {
+	case *drumKit != "":
+		kit, err := buildoutput.LoadDrumKit(*drumKit)
+		if err != nil {
+			log.Fatalf("Error loading drum kit: %v", err)
+		}
+		buildoutput.Drums = kit
+	case *drums:
+		buildoutput.Drums = buildoutput.NewDrumKit("temp_drums")
+	}
+
+	// The profile applies to every mode that encodes clips, including the
+	// hit extraction below
+	p, err := profile.Get(*profileName)
+	if err != nil {
+		log.Fatalf("Error selecting profile: %v", err)
+	}
+	if *configPath != "" {
+		if p, err = profile.Load(*configPath, p); err != nil {
+			log.Fatalf("Error loading profile config: %v", err)
+		}
+	}
+	outputProfile = p
+	buildoutput.OutputProfile = p
+
+	if *record != "" {
+		if err := recordPerformance(*record, *recordPort, *recordReplay, *recordBPM, *preview); err != nil {
+			log.Fatalf("Error recording: %v", err)
+		}
+		return
+	}
+
+	if *extractHits {
+		if flag.NArg() < 1 {
+			log.Fatalf("Usage: go run main.go -extract-hits [-hit-names kick,snare,...] [-profile name] [-config file.json] <video-file>")
+		}
+		audioPath := "audio.wav"
+		if err := audiopack.ExtractAudio(flag.Arg(0), audioPath); err != nil {
+			log.Fatalf("Error extracting audio: %v", err)
+		}
+		hits, err := audiopack.DetectHits(audioPath, 0.5)
+		if err != nil {
+			log.Fatalf("Error detecting hits: %v", err)
+		}
+		var names []string
+		if *hitNames != "" {
+			names = strings.Split(*hitNames, ",")
+		}
+		if err := splitHits(flag.Arg(0), hits, names, "temp_drums"); err != nil {
+			log.Fatalf("Error splitting hits: %v", err)
+		}
+		return
+	}
+
+	if *transcribe != "" {
+		if flag.NArg() < 1 {
+			log.Fatalf("Usage: go run main.go -transcribe out.mid [-transcribe-bpm n] [-snap-scale [-scale-key k]] <video-file>")
+		}
+		if err := transcribeVideo(flag.Arg(0), *transcribe, *transcribeBPM); err != nil {
+			log.Fatalf("Error transcribing: %v", err)
+		}
+		return
+	}
+
+	if flag.NArg() < 2 && (*melodyFrom == "" || flag.NArg() < 1) {
+		log.Fatalf("Usage: go run main.go [-backend ffmpeg|compositor] [-batch-size n] [-profile name] [-config file.json] [-crop mode] [-crop-boxes file.json] [-backgrounds file.json] [-backing file -backing-offset s -backing-gain dB -duck] [-pan mode] [-effects file.json] [-visual-fx file.json] [-transition kind -transition-duration s] [-note-names] [-lyrics] [-piano-roll] [-font file] [-quantize n -quantize-strength s -swing s] [-tempo-scale x] [-bars from-to] [-transpose n|suggest|auto [-fit-tracks]] [-arpeggio pattern -arpeggio-step s] [-harmony steps -key k] [-max-voices n -steal rule] [-drums] [-drum-kit file.json] <video-file> <midi-file|musicxml-file|note-list>\n   or: go run main.go -record out.mid [-record-port name | -record-replay file.mid] [-record-bpm n] [-preview]\n   or: go run main.go -melody-from reference.wav [-melody-bpm n] [-min-note s] [options] <video-file>\n   or: go run main.go -extract-hits [-hit-names kick,snare,...] [-profile name] [-config file.json] <video-file>")
+	}
+
+	switch buildoutput.PanMode(*pan) {
+	case buildoutput.PanCenter, buildoutput.PanCC10, buildoutput.PanPitch, buildoutput.PanLayout:
+		buildoutput.Pan = buildoutput.PanMode(*pan)
+	default:
+		log.Fatalf("Unknown pan mode %q", *pan)
+	}
+	if *panWidth < 0 || *panWidth > 1 {
+		log.Fatalf("-pan-width must be between 0 and 1, got %g", *panWidth)
+	}
+	buildoutput.PanWidth = *panWidth
+	switch buildoutput.TransitionKind(*transition) {
+	case buildoutput.TransitionCut, buildoutput.TransitionFade, buildoutput.TransitionWipe, buildoutput.TransitionSlide:
+		buildoutput.Transition = buildoutput.TransitionKind(*transition)
+	default:
+		log.Fatalf("Unknown transition %q", *transition)
+	}
+	buildoutput.TransitionDuration = *transitionDuration
+	if *effects != "" {
+		if err := buildoutput.LoadEffects(*effects); err != nil {
+			log.Fatalf("Error loading effects: %v", err)
+		}
+	}
+	if *visualFX != "" {
+		if err := buildoutput.LoadVisualEffects(*visualFX); err != nil {
+			log.Fatalf("Error loading visual effects: %v", err)
+		}
+	}
+	buildoutput.Mix.VoiceGainDB = *voiceGain
+	buildoutput.Mix.LoudnessLUFS = *loudness
+
+	if *backingPath != "" {
+		if _, err := os.Stat(*backingPath); err != nil {
+			log.Fatalf("Error opening backing track: %v", err)
+		}
+		buildoutput.Backing = &buildoutput.BackingTrack{
+			Path:   *backingPath,
+			Offset: *backingOffset,
+			GainDB: *backingGain,
+			Duck:   *duck,
+		}
+	}
+
+	switch buildoutput.CropMode(*crop) {
+	case buildoutput.CropFit, buildoutput.CropCenter, buildoutput.CropManual, buildoutput.CropAuto:
+		buildoutput.Crop = buildoutput.CropMode(*crop)
+	default:
+		log.Fatalf("Unknown crop mode %q", *crop)
+	}
+	if *cropBoxes != "" {
+		if err := buildoutput.LoadCropBoxes(*cropBoxes); err != nil {
+			log.Fatalf("Error loading crop boxes: %v", err)
+		}
+	}
+
+	if *batchSize < 1 {
+		log.Fatalf("-batch-size must be at least 1")
+	}
+	buildoutput.MaxEventsPerBatch = *batchSize
+
+	switch buildoutput.Backend(*backend) {
+	case buildoutput.BackendFFmpeg, buildoutput.BackendCompositor:
+		buildoutput.RenderBackend = buildoutput.Backend(*backend)
+	default:
+		log.Fatalf("Unknown backend %q", *backend)
 	}
 
 	// cleanUpTempDirs()
 
-	// videoPath := os.Args[1]
+	// videoPath := flag.Arg(0)
 
 	// // Step 1: Extract audio and run aubionotes
 	// audioPath := "audio.wav"
@@ -104,13 +400,122 @@ func main() {
 	// 	log.Fatalf("Error splitting video: %v", err)
 	// }
 
-	midiFilePath := os.Args[2]
+	midiFilePath := flag.Arg(1)
 
 	outputFile := "final_output_with_audio.mp4"
 
-	events, err := midiparse.ParseMIDI(midiFilePath)
-	if err != nil {
-		panic(err)
+	var song *midiparse.Song
+	if *melodyFrom != "" {
+		opts := audiopack.DefaultMelodyOptions
+		opts.BPM, opts.MinNoteLength = *melodyBPM, *minNote
+		notes, err := audiopack.TranscribeMelody(*melodyFrom, opts)
+		if err != nil {
+			log.Fatalf("Error transcribing melody: %v", err)
+		}
+		song = &midiparse.Song{Notes: notes, TrackNames: map[int]string{}}
+	} else {
+		song, err = midiparse.ParseScore(midiFilePath)
+		if err != nil {
+			panic(err)
+		}
+	}
+	events := song.Notes
+
+	// Optional timing edits; markers and lyrics are moved along with the notes
+	editTime := func(t float64) float64 { return t }
+	editMarkers := func(m []midiparse.Marker) []midiparse.Marker { return append([]midiparse.Marker(nil), m...) }
+	edit := midiparse.Edit{Grid: *quantize, Strength: *quantizeStrength, Swing: *swing, TempoScale: *tempoScale}
+	if *bars != "" {
+		if _, err := fmt.Sscanf(*bars, "%d-%d", &edit.FromBar, &edit.ToBar); err != nil {
+			log.Fatalf("Invalid bar range %q, want from-to", *bars)
+		}
+	}
+	if edit.Grid > 0 || edit.FromBar > 0 || edit.ToBar > 0 || edit.TempoScale != 1 {
+		tempoMap := song.TempoMap
+		if tempoMap == nil {
+			log.Fatalf("Timing edits need a MIDI file timed in ticks per quarter note")
+		}
+		events = tempoMap.Apply(events, edit)
+		editTime = func(t float64) float64 { return tempoMap.EditTime(t, edit) }
+		editMarkers = func(m []midiparse.Marker) []midiparse.Marker { return tempoMap.EditMarkers(m, edit) }
+		fmt.Printf("Edited timing: %d events remain\n", len(events))
+
+		// The backing track follows the bar range; it cannot be time-stretched
+		if buildoutput.Backing != nil {
+			if edit.TempoScale != 1 {
+				log.Fatalf("-tempo-scale cannot be combined with -backing")
+			}
+			buildoutput.Backing.Offset = editTime(buildoutput.Backing.Offset)
+			if edit.ToBar > 0 {
+				buildoutput.Backing.Until = editTime(tempoMap.Seconds(tempoMap.BarTick(edit.ToBar + 1)))
+			}
+		}
+	}
+
+	switch *transpose {
+	case "":
+	case "suggest", "auto":
+		library, err := buildoutput.LibraryNotes()
+		if err != nil {
+			log.Fatalf("Error reading clip library: %v", err)
+		}
+		fit := buildoutput.FitKey(events, library, *fitTracks)
+		fmt.Printf("Best fit to the clip library: %s\n", fit)
+		if *transpose == "auto" {
+			if events, err = fit.Apply(events); err != nil {
+				log.Fatalf("Error transposing: %v", err)
+			}
+		}
+	default:
+		semitones, err := strconv.Atoi(*transpose)
+		if err != nil {
+			log.Fatalf("Invalid -transpose %q, want semitones, suggest or auto", *transpose)
+		}
+		if events, err = (buildoutput.KeyFit{Transpose: semitones}).Apply(events); err != nil {
+			log.Fatalf("Error transposing: %v", err)
+		}
+	}
+
+	// Arrangement passes: arpeggios, harmony, then the polyphony limit. Drums
+	// on channel 10 pass through untouched.
+	if *arpeggio != "" {
+		events, err = midiparse.Arpeggiate(events, midiparse.Arpeggio{Pattern: *arpeggio, Step: *arpeggioStep})
+		if err != nil {
+			log.Fatalf("Error arpeggiating: %v", err)
+		}
+	}
+	if *harmony != 0 {
+		k, err := midiparse.ParseKey(*key)
+		if err != nil {
+			log.Fatalf("Error reading key: %v", err)
+		}
+		events = midiparse.Harmonize(events, k, *harmony)
+	}
+	if *maxVoices > 0 {
+		events, err = midiparse.LimitPolyphony(events, *maxVoices, *steal)
+		if err != nil {
+			log.Fatalf("Error limiting polyphony: %v", err)
+		}
+	}
+
+	if *backgrounds != "" {
+		if err := buildoutput.LoadBackgrounds(*backgrounds); err != nil {
+			log.Fatalf("Error loading backgrounds: %v", err)
+		}
+		// A section that began before the bar range is showing at its start
+		markers := append([]midiparse.Marker(nil), song.Markers...)
+		for i := range markers {
+			markers[i].Time = math.Max(0, editTime(markers[i].Time))
+		}
+		if err := buildoutput.ResolveBackgroundMarkers(markers); err != nil {
+			log.Fatalf("Error placing backgrounds: %v", err)
+		}
+	}
+
+	buildoutput.Overlay = buildoutput.Overlays{NoteNames: *noteNames, Lyrics: *lyrics, PianoRoll: *pianoRoll}
+	buildoutput.OverlayFont = *font
+	if *lyrics {
+		buildoutput.Lyrics = editMarkers(song.KaraokeLyrics())
 	}
 
 	fmt.Println("Parsed MIDI events:", len(events))
@@ -0,0 +1,90 @@
+package midiparse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Key is a major or natural minor key.
+type Key struct {
+	Tonic int // pitch class, 0 = C
+	Minor bool
+}
+
+var (
+	majorSteps = [7]int{0, 2, 4, 5, 7, 9, 11}
+	minorSteps = [7]int{0, 2, 3, 5, 7, 8, 10}
+)
+
+// ParseKey parses a key such as "C", "F#m", "Bb minor" or "A major".
+func ParseKey(s string) (Key, error) {
+	s = strings.TrimSpace(s)
+	var k Key
+	switch lower := strings.ToLower(s); {
+	case strings.HasSuffix(lower, " minor"):
+		k.Minor, s = true, s[:len(s)-len(" minor")]
+	case strings.HasSuffix(lower, " major"):
+		s = s[:len(s)-len(" major")]
+	case strings.HasSuffix(s, "m") && len(s) > 1:
+		k.Minor, s = true, s[:len(s)-1]
+	}
+	note, err := ParseNoteName(strings.TrimSpace(s) + "4")
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid key %q", s)
+	}
+	k.Tonic = note % 12
+	return k, nil
+}
+
+// String returns the key as e.g. "F# minor".
+func (k Key) String() string {
+	mode := "major"
+	if k.Minor {
+		mode = "minor"
+	}
+	return fmt.Sprintf("%s %s", noteNames[k.Tonic], mode)
+}
+
+// steps returns the semitone offsets of the scale degrees from the tonic.
+func (k Key) steps() [7]int {
+	if k.Minor {
+		return minorSteps
+	}
+	return majorSteps
+}
+
+// Degree returns the scale degree (0-6) of a note and its octave in degree
+// steps, rounding chromatic notes down to the scale tone below.
+func (k Key) Degree(note int) (degree, octave int) {
+	rel := note - k.Tonic
+	octave = floorDiv(rel, 12)
+	pc := rel - octave*12
+	for i, step := range k.steps() {
+		if step <= pc {
+			degree = i
+		}
+	}
+	return degree, octave
+}
+
+// Note returns the note of a scale degree in an octave, the inverse of Degree;
+// degrees outside 0-6 wrap into neighbouring octaves.
+func (k Key) Note(degree, octave int) int {
+	octave += floorDiv(degree, 7)
+	degree -= floorDiv(degree, 7) * 7
+	return k.Tonic + octave*12 + k.steps()[degree]
+}
+
+// Contains reports whether a note is in the scale.
+func (k Key) Contains(note int) bool {
+	d, o := k.Degree(note)
+	return k.Note(d, o) == note
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
@@ -2,7 +2,10 @@ package midiparse
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"sort"
+	"strings"
 
 	"gitlab.com/gomidi/midi/v2/smf"
 
@@ -13,9 +16,61 @@ type NoteEvent struct {
 	Note     int
 	Start    float64 // in seconds
 	Duration float64 // in seconds
+	Track    int
+	Channel  int     // 0-15
+	Velocity int     // 1-127
+	Pan      float64 // -1 (left) to 1 (right), from the channel's CC10 at note start; 0 without one
+
+	StartTick, EndTick int64   // absolute ticks
+	Bar                int     // 1-based bar of the note start
+	Beat               float64 // 1-based beat within the bar, with fraction
+}
+
+// noteKey identifies a sounding note: the same key can sound on several
+// channels at once.
+type noteKey struct {
+	track, channel, key int
+}
+
+// panChange is a CC10 on a channel, in absolute ticks.
+type panChange struct {
+	tick int64
+	pan  float64
+}
+
+// Song is everything read from a MIDI file: the notes plus the meta events
+// later stages use for sections, overlays and layout. Meta events are in
+// time order.
+type Song struct {
+	Notes      []NoteEvent
+	Markers    []Marker
+	CuePoints  []Marker
+	Lyrics     []Marker
+	Texts      []Marker
+	TrackNames map[int]string
+	Tempos     []TempoChange
+	Meters     []Meter   // as in the file; TempoMap.Meters adds the 4/4 default
+	TempoMap   *TempoMap // nil for SMPTE-timed files
+}
+
+// TempoChange is a tempo meta event.
+type TempoChange struct {
+	Tick int64
+	Time float64 // in seconds
+	BPM  float64
 }
 
+// ParseMIDI returns the notes of a MIDI file.
 func ParseMIDI(filename string) ([]NoteEvent, error) {
+	song, err := ParseSong(filename)
+	if err != nil {
+		return nil, err
+	}
+	return song.Notes, nil
+}
+
+// ParseSong reads the notes and meta events of a MIDI file in one pass.
+func ParseSong(filename string) (*Song, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
@@ -25,7 +80,9 @@ func ParseMIDI(filename string) ([]NoteEvent, error) {
 	fmt.Printf("Opened file: %s\n", filename)
 
 	var events []NoteEvent
-	noteStart := map[int]float64{}
+	noteStart := map[noteKey]NoteEvent{}
+	pans := map[int][]panChange{} // channel -> CC10 events from every track
+	song := &Song{TrackNames: map[int]string{}}
 
 	reader := smf.ReadTracksFrom(f)
 	fmt.Printf("Created reader: %+v\n", reader)
@@ -35,6 +92,14 @@ func ParseMIDI(filename string) ([]NoteEvent, error) {
 		callbackCount++
 		fmt.Printf("Event: %v\n", ev.Message)
 
+		collectMeta(song, ev)
+
+		var ccCh, cc, ccVal uint8
+		if ev.Message.GetControlChange(&ccCh, &cc, &ccVal) && cc == 10 {
+			// CC10 pan: 0 hard left, 64 centre, 127 hard right
+			pans[int(ccCh)] = append(pans[int(ccCh)], panChange{ev.AbsTicks, (float64(ccVal) - 64) / 63})
+		}
+
 		var ch, key, vel uint8
 		gotNoteStart := ev.Message.GetNoteStart(&ch, &key, &vel)
 		fmt.Printf("GetNoteStart returned: %v\n", gotNoteStart)
@@ -42,7 +107,14 @@ func ParseMIDI(filename string) ([]NoteEvent, error) {
 		if gotNoteStart {
 			fmt.Printf("Note Start - Channel: %d, Key: %d, Velocity: %d, Time: %f\n",
 				ch, key, vel, float64(ev.AbsMicroSeconds)/1_000_000)
-			noteStart[int(key)] = float64(ev.AbsMicroSeconds) / 1_000_000
+			noteStart[noteKey{ev.TrackNo, int(ch), int(key)}] = NoteEvent{
+				Note:      int(key),
+				Start:     float64(ev.AbsMicroSeconds) / 1_000_000,
+				StartTick: ev.AbsTicks,
+				Track:     ev.TrackNo,
+				Channel:   int(ch),
+				Velocity:  int(vel),
+			}
 		}
 
 		var ch2, key2 uint8
@@ -52,14 +124,13 @@ func ParseMIDI(filename string) ([]NoteEvent, error) {
 		if gotNoteEnd {
 			fmt.Printf("Note End - Channel: %d, Key: %d, Time: %f\n",
 				ch2, key2, float64(ev.AbsMicroSeconds)/1_000_000)
-			if start, ok := noteStart[int(key2)]; ok {
+			k := noteKey{ev.TrackNo, int(ch2), int(key2)}
+			if e, ok := noteStart[k]; ok {
 				end := float64(ev.AbsMicroSeconds) / 1_000_000
-				events = append(events, NoteEvent{
-					Note:     int(key2),
-					Start:    start,
-					Duration: end - start,
-				})
-				delete(noteStart, int(key2))
+				e.Duration = end - e.Start
+				e.EndTick = ev.AbsTicks
+				events = append(events, e)
+				delete(noteStart, k)
 			}
 		}
 	})
@@ -67,5 +138,106 @@ func ParseMIDI(filename string) ([]NoteEvent, error) {
 	fmt.Printf("Callback executed %d times\n", callbackCount)
 	fmt.Printf("Total events collected: %d\n", len(events))
 
-	return events, nil
+	if err := reader.Error(); err != nil {
+		return nil, fmt.Errorf("failed to read MIDI file: %w", err)
+	}
+
+	// Pan is per channel, and the controller may sit on another track than
+	// the notes, so it is resolved once every track has been read
+	for ch, list := range pans {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].tick < list[j].tick })
+		pans[ch] = list
+	}
+	for i, e := range events {
+		list := pans[e.Channel]
+		if n := sort.Search(len(list), func(j int) bool { return list[j].tick > e.StartTick }); n > 0 {
+			events[i].Pan = math.Max(-1, math.Min(1, list[n-1].pan))
+		}
+	}
+
+	song.Notes = events
+	for _, list := range [][]Marker{song.Markers, song.CuePoints, song.Lyrics, song.Texts} {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Time < list[j].Time
+		})
+	}
+	sort.SliceStable(song.Tempos, func(i, j int) bool {
+		return song.Tempos[i].Tick < song.Tempos[j].Tick
+	})
+	fmt.Printf("Meta events: %d markers, %d cue points, %d lyrics, %d texts, %d tempo changes, %d time signatures\n",
+		len(song.Markers), len(song.CuePoints), len(song.Lyrics), len(song.Texts), len(song.Tempos), len(song.Meters))
+
+	song.TempoMap, err = newTempoMap(reader.SMF(), append([]Meter(nil), song.Meters...))
+	if err != nil {
+		fmt.Printf("No bar positions: %v\n", err)
+		return song, nil
+	}
+	for i := range song.Notes {
+		song.Notes[i].Bar, song.Notes[i].Beat = song.TempoMap.BarBeat(song.Notes[i].StartTick)
+	}
+
+	return song, nil
+}
+
+// collectMeta files a meta event into the song.
+func collectMeta(song *Song, ev smf.TrackEvent) {
+	marker := func(text string) Marker {
+		return Marker{Time: float64(ev.AbsMicroSeconds) / 1_000_000, Text: text, Track: ev.TrackNo}
+	}
+
+	var text string
+	var bpm float64
+	switch {
+	case ev.Message.GetMetaMarker(&text):
+		song.Markers = append(song.Markers, marker(text))
+	case ev.Message.GetMetaCuepoint(&text):
+		song.CuePoints = append(song.CuePoints, marker(text))
+	case ev.Message.GetMetaLyric(&text):
+		song.Lyrics = append(song.Lyrics, marker(text))
+	case ev.Message.GetMetaText(&text):
+		song.Texts = append(song.Texts, marker(text))
+	case ev.Message.GetMetaTrackName(&text):
+		song.TrackNames[ev.TrackNo] = text
+	case ev.Message.GetMetaTempo(&bpm):
+		song.Tempos = append(song.Tempos, TempoChange{
+			Tick: ev.AbsTicks,
+			Time: float64(ev.AbsMicroSeconds) / 1_000_000,
+			BPM:  bpm,
+		})
+	default:
+		if m, ok := meterOf(ev); ok {
+			song.Meters = append(song.Meters, m)
+		}
+	}
+}
+
+// Marker is a timed text meta event: a marker naming a song section, a cue
+// point, a lyric syllable or a text event.
+type Marker struct {
+	Time  float64 // in seconds
+	Text  string
+	Track int
+}
+
+// KaraokeLyrics returns the song's lyric syllables. Files without lyric meta
+// events fall back to text events, as in .kar karaoke files; their "@"
+// header lines are skipped.
+func (s *Song) KaraokeLyrics() []Marker {
+	if len(s.Lyrics) > 0 {
+		return s.Lyrics
+	}
+	var lyrics []Marker
+	for _, t := range s.Texts {
+		if !strings.HasPrefix(t.Text, "@") {
+			lyrics = append(lyrics, t)
+		}
+	}
+	return lyrics
+}
+
+var noteNames = [12]string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// NoteName returns the scientific pitch name of a MIDI note, e.g. 60 is C4.
+func NoteName(note int) string {
+	return fmt.Sprintf("%s%d", noteNames[((note%12)+12)%12], note/12-1)
 }
@@ -0,0 +1,136 @@
+package midiparse
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/gomidi/midi/v2"
+	"gitlab.com/gomidi/midi/v2/smf"
+)
+
+// TestPanFromControllerTrack reads a format-1 file whose CC10 events are on a
+// different track from the notes they pan.
+func TestPanFromControllerTrack(t *testing.T) {
+	var controllers, notes smf.Track
+	controllers.Add(0, midi.ControlChange(0, 10, 127))
+	controllers.Add(960, midi.ControlChange(0, 10, 0))
+	controllers.Close(0)
+
+	notes.Add(0, midi.NoteOn(0, 60, 100))
+	notes.Add(480, midi.NoteOff(0, 60))
+	notes.Add(480, midi.NoteOn(0, 62, 100))
+	notes.Add(480, midi.NoteOff(0, 62))
+	notes.Add(0, midi.NoteOn(1, 64, 100))
+	notes.Add(480, midi.NoteOff(1, 64))
+	notes.Close(0)
+
+	s := smf.New()
+	s.TimeFormat = smf.MetricTicks(960)
+	for _, tr := range []smf.Track{controllers, notes} {
+		if err := s.Add(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "pan.mid")
+	if err := s.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := ParseMIDI(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]float64{60: 1, 62: -1, 64: 0}
+	if len(events) != len(want) {
+		t.Fatalf("got %d notes, want %d", len(events), len(want))
+	}
+	for _, e := range events {
+		if e.Pan != want[e.Note] {
+			t.Errorf("note %d on channel %d: pan %.3f, want %.3f", e.Note, e.Channel, e.Pan, want[e.Note])
+		}
+	}
+}
+
+// writeSMF writes a format-1 file at 960 ticks per quarter.
+func writeSMF(t *testing.T, tracks ...smf.Track) string {
+	t.Helper()
+	s := smf.New()
+	s.TimeFormat = smf.MetricTicks(960)
+	for _, tr := range tracks {
+		tr.Close(0)
+		if err := s.Add(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "song.mid")
+	if err := s.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseSongMeta(t *testing.T) {
+	// At 120 BPM a quarter (960 ticks) is 0.5s; the tempo halves at tick 1920
+	var conductor, melody smf.Track
+	conductor.Add(0, smf.MetaTrackSequenceName("My Song"))
+	conductor.Add(0, smf.MetaTempo(120))
+	conductor.Add(0, smf.MetaMeter(3, 4))
+	conductor.Add(960, smf.MetaMarker("Verse"))
+	conductor.Add(0, smf.MetaCuepoint("Lights"))
+	conductor.Add(960, smf.MetaTempo(60))
+	conductor.Add(960, smf.MetaMarker("Chorus"))
+
+	melody.Add(0, smf.MetaTrackSequenceName("Melody"))
+	melody.Add(0, smf.MetaLyric("Hel"))
+	melody.Add(0, midi.NoteOn(0, 60, 100))
+	melody.Add(480, smf.MetaLyric("lo "))
+	melody.Add(0, midi.NoteOff(0, 60))
+	melody.Add(0, smf.MetaText("@TTitle"))
+
+	song, err := ParseSong(writeSMF(t, conductor, melody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(song.TrackNames, map[int]string{0: "My Song", 1: "Melody"}) {
+		t.Errorf("track names = %v", song.TrackNames)
+	}
+	wantMarkers := []Marker{{Time: 0.5, Text: "Verse"}, {Time: 2, Text: "Chorus"}}
+	if !reflect.DeepEqual(song.Markers, wantMarkers) {
+		t.Errorf("markers = %+v, want %+v", song.Markers, wantMarkers)
+	}
+	if want := []Marker{{Time: 0.5, Text: "Lights"}}; !reflect.DeepEqual(song.CuePoints, want) {
+		t.Errorf("cue points = %+v, want %+v", song.CuePoints, want)
+	}
+	wantTempos := []TempoChange{{Tick: 0, Time: 0, BPM: 120}, {Tick: 1920, Time: 1, BPM: 60}}
+	if !reflect.DeepEqual(song.Tempos, wantTempos) {
+		t.Errorf("tempos = %+v, want %+v", song.Tempos, wantTempos)
+	}
+	if want := []Meter{{Tick: 0, Num: 3, Denom: 4}}; !reflect.DeepEqual(song.Meters, want) {
+		t.Errorf("meters = %+v, want %+v", song.Meters, want)
+	}
+
+	// Lyric events win over text events for karaoke
+	wantLyrics := []Marker{{Time: 0, Text: "Hel", Track: 1}, {Time: 0.25, Text: "lo ", Track: 1}}
+	if got := song.KaraokeLyrics(); !reflect.DeepEqual(got, wantLyrics) {
+		t.Errorf("lyrics = %+v, want %+v", got, wantLyrics)
+	}
+}
+
+func TestKaraokeLyricsFromText(t *testing.T) {
+	var words smf.Track
+	words.Add(0, smf.MetaText("@KMIDI KARAOKE FILE"))
+	words.Add(0, smf.MetaText("@TMy Song"))
+	words.Add(960, smf.MetaText("/Hel"))
+	words.Add(480, smf.MetaText("lo"))
+
+	song, err := ParseSong(writeSMF(t, words))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Marker{{Time: 0.5, Text: "/Hel"}, {Time: 0.75, Text: "lo"}}
+	if got := song.KaraokeLyrics(); !reflect.DeepEqual(got, want) {
+		t.Errorf("lyrics = %+v, want %+v", got, want)
+	}
+}
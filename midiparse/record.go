@@ -0,0 +1,144 @@
+package midiparse
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/gomidi/midi/v2"
+	"gitlab.com/gomidi/midi/v2/smf"
+)
+
+// recordResolution is the tick resolution of recorded files.
+const recordResolution = 960
+
+// Recording captures live channel messages with their timing into one
+// track, written out as a Standard MIDI File at a fixed tempo.
+type Recording struct {
+	BPM    float64
+	OnNote func(channel, key, velocity uint8) // called for every note-on, e.g. to preview the clip
+
+	mu       sync.Mutex
+	track    smf.Track
+	lastTick int64
+	notes    int
+}
+
+// NewRecording starts an empty recording at bpm.
+func NewRecording(bpm float64) (*Recording, error) {
+	if bpm <= 0 {
+		return nil, fmt.Errorf("tempo must be positive, got %g BPM", bpm)
+	}
+	r := &Recording{BPM: bpm}
+	r.track.Add(0, smf.MetaTempo(bpm))
+	return r, nil
+}
+
+// Capture adds a message received at time at since the recording started.
+// Only channel messages are kept; messages arriving out of order are placed
+// at the latest time seen.
+func (r *Recording) Capture(msg midi.Message, at time.Duration) {
+	if !msg.Is(midi.ChannelMsg) {
+		return
+	}
+	var ch, key, vel uint8
+	if msg.GetNoteStart(&ch, &key, &vel) && r.OnNote != nil {
+		r.OnNote(ch, key, vel)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tick := int64(at.Seconds()*recordResolution*r.BPM/60 + 0.5)
+	if tick < r.lastTick {
+		tick = r.lastTick
+	}
+	r.track.Add(uint32(tick-r.lastTick), msg)
+	r.lastTick = tick
+	if msg.GetNoteStart(nil, nil, nil) {
+		r.notes++
+	}
+}
+
+// WriteFile closes the track and writes the recording.
+func (r *Recording) WriteFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.track.Close(0)
+	s := smf.New()
+	s.TimeFormat = smf.MetricTicks(recordResolution)
+	if err := s.Add(r.track); err != nil {
+		return fmt.Errorf("failed to build recording: %w", err)
+	}
+	if err := s.WriteFile(path); err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	fmt.Printf("Recorded %d notes to %s\n", r.notes, path)
+	return nil
+}
+
+// InPorts lists the MIDI input ports of the registered driver.
+func InPorts() []string {
+	var names []string
+	for _, in := range midi.GetInPorts() {
+		names = append(names, in.String())
+	}
+	return names
+}
+
+// ListenPort records from the input port whose name contains name (the first
+// port if name is empty) until stop is called.
+func ListenPort(name string, r *Recording) (stop func(), err error) {
+	port, err := midi.InPort(0)
+	if name != "" {
+		port, err = midi.FindInPort(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no MIDI input port %q (have %v): %w", name, InPorts(), err)
+	}
+	fmt.Printf("Recording from %s\n", port)
+
+	start := time.Now()
+	stop, err = midi.ListenTo(port, func(msg midi.Message, _ int32) {
+		r.Capture(msg, time.Since(start))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen to %s: %w", port, err)
+	}
+	return stop, nil
+}
+
+// ReplayFile feeds the channel messages of a MIDI file through a recording as
+// if they were played live, for testing without a controller. With realtime
+// set it waits for each message's time, so previews sound as they would.
+func ReplayFile(path string, r *Recording, realtime bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	var events []smf.TrackEvent
+	reader := smf.ReadTracksFrom(f)
+	reader.Do(func(ev smf.TrackEvent) {
+		events = append(events, ev)
+	})
+	if err := reader.Error(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].AbsMicroSeconds < events[j].AbsMicroSeconds
+	})
+
+	start := time.Now()
+	for _, ev := range events {
+		at := time.Duration(ev.AbsMicroSeconds) * time.Microsecond
+		if realtime {
+			time.Sleep(time.Until(start.Add(at)))
+		}
+		r.Capture(midi.Message(ev.Message), at)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package midiparse
+
+import "testing"
+
+func TestNewRecordingRejectsTempo(t *testing.T) {
+	for _, bpm := range []float64{0, -90} {
+		if _, err := NewRecording(bpm); err == nil {
+			t.Errorf("NewRecording(%g) did not fail", bpm)
+		}
+	}
+}
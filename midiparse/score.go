@@ -0,0 +1,306 @@
+package midiparse
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultVelocity is given to notes from formats without dynamics.
+const defaultVelocity = 100
+
+// ParseScore reads a score by file extension: .mid/.midi as MIDI,
+// .musicxml/.xml as uncompressed MusicXML and anything else as a note list
+// (see ParseNoteList). Only MIDI files carry a tempo map and meta events.
+func ParseScore(filename string) (*Song, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".mid", ".midi", ".kar":
+		return ParseSong(filename)
+	case ".musicxml", ".xml":
+		return ParseMusicXML(filename)
+	default:
+		return ParseNoteList(filename)
+	}
+}
+
+// ParseNoteName parses a scientific pitch name such as C4, F#3 or Bb2 (C4 is
+// 60), or a plain MIDI note number.
+func ParseNoteName(name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 0 || n > 127 {
+			return 0, fmt.Errorf("note %d out of range", n)
+		}
+		return n, nil
+	}
+	if name == "" {
+		return 0, fmt.Errorf("empty note name")
+	}
+
+	step := strings.Index("C D EF G A B", strings.ToUpper(name[:1]))
+	if step < 0 || name[0] == ' ' {
+		return 0, fmt.Errorf("invalid note name %q", name)
+	}
+	rest := name[1:]
+	for len(rest) > 0 && (rest[0] == '#' || rest[0] == 'b') {
+		if rest[0] == '#' {
+			step++
+		} else {
+			step--
+		}
+		rest = rest[1:]
+	}
+	octave, err := strconv.Atoi(rest)
+	if err != nil {
+		return 0, fmt.Errorf("invalid octave in note name %q", name)
+	}
+	n := (octave+1)*12 + step
+	if n < 0 || n > 127 {
+		return 0, fmt.Errorf("note %q out of range", name)
+	}
+	return n, nil
+}
+
+// ParseNoteList reads a plain-text note list, one note per line:
+//
+//	<note> <start seconds> <duration seconds> [velocity]
+//
+// e.g. "C4 0.0 0.5". Notes are names or MIDI numbers; blank lines and lines
+// starting with # are ignored.
+func ParseNoteList(filename string) (*Song, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	song := &Song{TrackNames: map[int]string{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("%s:%d: want <note> <start> <duration> [velocity]", filename, line)
+		}
+
+		note, err := ParseNoteName(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		start, err1 := strconv.ParseFloat(fields[1], 64)
+		duration, err2 := strconv.ParseFloat(fields[2], 64)
+		if err1 != nil || err2 != nil || start < 0 || duration <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid start or duration", filename, line)
+		}
+		velocity := defaultVelocity
+		if len(fields) == 4 {
+			velocity, err = strconv.Atoi(fields[3])
+			if err != nil || velocity < 1 || velocity > 127 {
+				return nil, fmt.Errorf("%s:%d: velocity must be 1-127", filename, line)
+			}
+		}
+
+		song.Notes = append(song.Notes, NoteEvent{
+			Note:     note,
+			Start:    start,
+			Duration: duration,
+			Velocity: velocity,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+
+	fmt.Printf("Notes read from %s: %d\n", filename, len(song.Notes))
+	return song, nil
+}
+
+// MusicXML elements used by ParseMusicXML (score-partwise only).
+type xmlScore struct {
+	XMLName xml.Name `xml:"score-partwise"`
+	Parts   []struct {
+		ID       string `xml:"id,attr"`
+		Measures []struct {
+			Items []xmlItem `xml:",any"`
+		} `xml:"measure"`
+	} `xml:"part"`
+	PartList []struct {
+		ID   string `xml:"id,attr"`
+		Name string `xml:"part-name"`
+	} `xml:"part-list>score-part"`
+}
+
+// xmlItem is any child of a measure; only the fields of its kind are set.
+type xmlItem struct {
+	XMLName xml.Name
+
+	// note
+	Pitch *struct {
+		Step   string  `xml:"step"`
+		Alter  float64 `xml:"alter"`
+		Octave int     `xml:"octave"`
+	} `xml:"pitch"`
+	Chord *struct{} `xml:"chord"`
+	Grace *struct{} `xml:"grace"`
+	Ties  []struct {
+		Type string `xml:"type,attr"`
+	} `xml:"tie"`
+
+	// note, backup, forward
+	Duration int `xml:"duration"`
+
+	// attributes
+	Divisions int `xml:"divisions"`
+
+	// direction/sound, or sound directly in the measure
+	Sound *struct {
+		Tempo float64 `xml:"tempo,attr"`
+	} `xml:"sound"`
+	Tempo float64 `xml:"tempo,attr"`
+}
+
+// quarterTempo is a tempo change at a position in quarter notes.
+type quarterTempo struct {
+	at  float64
+	bpm float64
+}
+
+// ParseMusicXML reads the notes of an uncompressed partwise MusicXML file.
+// Each part becomes a track; ties are merged and grace notes skipped. Tempo
+// comes from <sound tempo> in the first part, 120 BPM until the first one;
+// other parts repeat the same changes and are not read for tempo.
+func ParseMusicXML(filename string) (*Song, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	var score xmlScore
+	if err := xml.Unmarshal(data, &score); err != nil {
+		return nil, fmt.Errorf("failed to parse MusicXML %s: %w", filename, err)
+	}
+
+	type quarterNote struct {
+		NoteEvent
+		start, length float64 // in quarter notes
+	}
+	var notes []quarterNote
+	tempos := []quarterTempo{{0, 120}}
+	song := &Song{TrackNames: map[int]string{}}
+
+	for track, part := range score.Parts {
+		for _, p := range score.PartList {
+			if p.ID == part.ID {
+				song.TrackNames[track] = p.Name
+			}
+		}
+
+		divisions := 1.0
+		pos, lastStart := 0.0, 0.0
+		tied := map[int]int{} // note -> index in notes of a note tied onward
+		for _, measure := range part.Measures {
+			for _, item := range measure.Items {
+				length := float64(item.Duration) / divisions
+				switch item.XMLName.Local {
+				case "attributes":
+					if item.Divisions > 0 {
+						divisions = float64(item.Divisions)
+					}
+				case "backup":
+					pos -= length
+				case "forward":
+					pos += length
+				case "sound":
+					if track == 0 && item.Tempo > 0 {
+						tempos = append(tempos, quarterTempo{pos, item.Tempo})
+					}
+				case "direction":
+					if track == 0 && item.Sound != nil && item.Sound.Tempo > 0 {
+						tempos = append(tempos, quarterTempo{pos, item.Sound.Tempo})
+					}
+				case "note":
+					if item.Grace != nil {
+						continue
+					}
+					start := pos
+					if item.Chord != nil {
+						start = lastStart
+					} else {
+						pos += length
+					}
+					lastStart = start
+					if item.Pitch == nil {
+						continue // rest
+					}
+
+					note, err := ParseNoteName(fmt.Sprintf("%s%d", item.Pitch.Step, item.Pitch.Octave))
+					if err != nil {
+						return nil, fmt.Errorf("MusicXML part %s: %w", part.ID, err)
+					}
+					note += int(math.Round(item.Pitch.Alter))
+
+					tieStart, tieStop := false, false
+					for _, t := range item.Ties {
+						tieStart = tieStart || t.Type == "start"
+						tieStop = tieStop || t.Type == "stop"
+					}
+					if i, ok := tied[note]; ok && tieStop {
+						notes[i].length = start + length - notes[i].start
+						if !tieStart {
+							delete(tied, note)
+						}
+						continue
+					}
+
+					notes = append(notes, quarterNote{
+						NoteEvent: NoteEvent{Note: note, Track: track, Velocity: defaultVelocity},
+						start:     start,
+						length:    length,
+					})
+					if tieStart {
+						tied[note] = len(notes) - 1
+					}
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(tempos, func(i, j int) bool {
+		return tempos[i].at < tempos[j].at
+	})
+	for _, t := range tempos[1:] {
+		song.Tempos = append(song.Tempos, TempoChange{Time: quartersToSeconds(t.at, tempos), BPM: t.bpm})
+	}
+	for _, n := range notes {
+		n.Start = quartersToSeconds(n.start, tempos)
+		n.Duration = quartersToSeconds(n.start+n.length, tempos) - n.Start
+		song.Notes = append(song.Notes, n.NoteEvent)
+	}
+
+	fmt.Printf("Notes read from %s: %d in %d parts\n", filename, len(song.Notes), len(score.Parts))
+	return song, nil
+}
+
+// quartersToSeconds converts a position in quarter notes to seconds through
+// the tempo changes, which are sorted and start at 0.
+func quartersToSeconds(q float64, tempos []quarterTempo) float64 {
+	seconds := 0.0
+	for i, t := range tempos {
+		if t.at >= q {
+			break
+		}
+		end := q
+		if i+1 < len(tempos) && tempos[i+1].at < q {
+			end = tempos[i+1].at
+		}
+		seconds += (end - t.at) * 60 / t.bpm
+	}
+	return seconds
+}
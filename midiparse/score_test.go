@@ -0,0 +1,174 @@
+package midiparse
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeScore(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseNoteName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    int
+		wantErr bool
+	}{
+		{"C4", 60, false},
+		{"c4", 60, false},
+		{"F#3", 54, false},
+		{"Bb2", 46, false},
+		{"C##4", 62, false},
+		{"C-1", 0, false},
+		{"G9", 127, false},
+		{"72", 72, false},
+		{"G#9", 0, true},
+		{"128", 0, true},
+		{"H4", 0, true},
+		{"C", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseNoteName(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseNoteName(%q) = %d, %v, want %d, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseNoteList(t *testing.T) {
+	path := writeScore(t, "notes.txt", "# melody\nC4 0.0 0.5\n\n  64 0.5 0.25 90  \n")
+	song, err := ParseNoteList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []NoteEvent{
+		{Note: 60, Start: 0, Duration: 0.5, Velocity: defaultVelocity},
+		{Note: 64, Start: 0.5, Duration: 0.25, Velocity: 90},
+	}
+	if len(song.Notes) != len(want) {
+		t.Fatalf("got %d notes, want %d", len(song.Notes), len(want))
+	}
+	for i, w := range want {
+		if song.Notes[i] != w {
+			t.Errorf("note %d = %+v, want %+v", i, song.Notes[i], w)
+		}
+	}
+
+	for _, bad := range []string{"C4 0.0", "C4 0 0.5 90 x", "C4 -1 0.5", "C4 0 0", "C4 0 0.5 128", "X4 0 0.5"} {
+		if _, err := ParseNoteList(writeScore(t, "bad.txt", bad)); err == nil {
+			t.Errorf("ParseNoteList(%q) did not fail", bad)
+		}
+	}
+}
+
+// testScore has two parts at 2 divisions per quarter. Part 1 has a chord, a
+// rest, a tie over the barline, a second voice after <backup>, a grace note,
+// a <forward> and a flat, with 120 BPM until a change to 60 in bar 2. Part
+// 2 repeats the tempo marks, as notation programs write them.
+const testScore = `<?xml version="1.0" encoding="UTF-8"?>
+<score-partwise version="3.1">
+  <part-list>
+    <score-part id="P1"><part-name>Lead</part-name></score-part>
+    <score-part id="P2"><part-name>Bass</part-name></score-part>
+  </part-list>
+  <part id="P1">
+    <measure number="1">
+      <attributes><divisions>2</divisions></attributes>
+      <direction><sound tempo="120"/></direction>
+      <note><pitch><step>C</step><octave>4</octave></pitch><duration>2</duration></note>
+      <note><chord/><pitch><step>E</step><octave>4</octave></pitch><duration>2</duration></note>
+      <note><rest/><duration>2</duration></note>
+      <note><pitch><step>G</step><octave>4</octave></pitch><duration>4</duration><tie type="start"/></note>
+    </measure>
+    <measure number="2">
+      <sound tempo="60"/>
+      <note><pitch><step>G</step><octave>4</octave></pitch><duration>2</duration><tie type="stop"/></note>
+      <backup><duration>2</duration></backup>
+      <note><grace/><pitch><step>C</step><octave>4</octave></pitch></note>
+      <note><pitch><step>D</step><octave>4</octave></pitch><duration>2</duration></note>
+      <forward><duration>2</duration></forward>
+      <note><pitch><step>B</step><alter>-1</alter><octave>4</octave></pitch><duration>2</duration></note>
+    </measure>
+  </part>
+  <part id="P2">
+    <measure number="1">
+      <attributes><divisions>1</divisions></attributes>
+      <direction><sound tempo="120"/></direction>
+      <note><pitch><step>C</step><octave>3</octave></pitch><duration>2</duration></note>
+    </measure>
+    <measure number="2">
+      <sound tempo="60"/>
+    </measure>
+  </part>
+</score-partwise>`
+
+func TestParseMusicXML(t *testing.T) {
+	song, err := ParseMusicXML(writeScore(t, "score.musicxml", testScore))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Quarters last 0.5s until quarter 4, then 1s
+	want := []struct {
+		note, track     int
+		start, duration float64
+	}{
+		{60, 0, 0, 0.5},
+		{64, 0, 0, 0.5},
+		{67, 0, 1, 2},
+		{62, 0, 2, 1},
+		{70, 0, 4, 1},
+		{48, 1, 0, 1},
+	}
+	if len(song.Notes) != len(want) {
+		t.Fatalf("got %d notes, want %d: %+v", len(song.Notes), len(want), song.Notes)
+	}
+	for i, w := range want {
+		n := song.Notes[i]
+		if n.Note != w.note || n.Track != w.track || math.Abs(n.Start-w.start) > 1e-9 || math.Abs(n.Duration-w.duration) > 1e-9 {
+			t.Errorf("note %d = %d on track %d at %.3f for %.3f, want %d on track %d at %.3f for %.3f",
+				i, n.Note, n.Track, n.Start, n.Duration, w.note, w.track, w.start, w.duration)
+		}
+	}
+
+	wantTempos := []TempoChange{{Time: 0, BPM: 120}, {Time: 2, BPM: 60}}
+	if len(song.Tempos) != len(wantTempos) {
+		t.Fatalf("tempos = %+v, want %+v", song.Tempos, wantTempos)
+	}
+	for i, w := range wantTempos {
+		if song.Tempos[i] != w {
+			t.Errorf("tempo %d = %+v, want %+v", i, song.Tempos[i], w)
+		}
+	}
+	if song.TrackNames[0] != "Lead" || song.TrackNames[1] != "Bass" {
+		t.Errorf("track names = %v", song.TrackNames)
+	}
+}
+
+func TestQuartersToSeconds(t *testing.T) {
+	tempos := []quarterTempo{{0, 120}, {4, 60}, {6, 240}}
+	tests := []struct {
+		q, want float64
+	}{
+		{0, 0},
+		{2, 1},
+		{4, 2},
+		{5, 3},
+		{6, 4},
+		{10, 5},
+	}
+	for _, tt := range tests {
+		if got := quartersToSeconds(tt.q, tempos); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("quartersToSeconds(%g) = %g, want %g", tt.q, got, tt.want)
+		}
+	}
+}
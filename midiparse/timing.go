@@ -0,0 +1,206 @@
+package midiparse
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"gitlab.com/gomidi/midi/v2/smf"
+)
+
+// Meter is a time signature change.
+type Meter struct {
+	Tick  int64
+	Num   int
+	Denom int
+}
+
+// TempoMap converts MIDI ticks to seconds and bar:beat positions using the
+// file's tempo changes and time signatures.
+type TempoMap struct {
+	TicksPerQuarter int
+	Meters          []Meter // sorted, always starting at tick 0 (4/4 if the file has none)
+
+	smf *smf.SMF
+}
+
+func meterOf(ev smf.TrackEvent) (Meter, bool) {
+	var num, denom uint8
+	if !ev.Message.GetMetaMeter(&num, &denom) || num == 0 || denom == 0 {
+		return Meter{}, false
+	}
+	return Meter{Tick: ev.AbsTicks, Num: int(num), Denom: int(denom)}, true
+}
+
+func newTempoMap(s *smf.SMF, meters []Meter) (*TempoMap, error) {
+	ticks, ok := s.TimeFormat.(smf.MetricTicks)
+	if !ok {
+		return nil, fmt.Errorf("SMPTE time format has no bars and beats")
+	}
+
+	sort.SliceStable(meters, func(i, j int) bool {
+		return meters[i].Tick < meters[j].Tick
+	})
+	m := &TempoMap{TicksPerQuarter: int(ticks.Resolution()), smf: s}
+	for _, mt := range meters {
+		if n := len(m.Meters); n > 0 && m.Meters[n-1].Tick == mt.Tick {
+			m.Meters[n-1] = mt
+			continue
+		}
+		m.Meters = append(m.Meters, mt)
+	}
+	if len(m.Meters) == 0 || m.Meters[0].Tick > 0 {
+		m.Meters = append([]Meter{{Tick: 0, Num: 4, Denom: 4}}, m.Meters...)
+	}
+	return m, nil
+}
+
+// Seconds returns the time of an absolute tick.
+func (m *TempoMap) Seconds(tick int64) float64 {
+	return float64(m.smf.TimeAt(tick)) / 1_000_000
+}
+
+func (m *TempoMap) ticksPerBar(mt Meter) int64 {
+	return int64(m.TicksPerQuarter) * 4 * int64(mt.Num) / int64(mt.Denom)
+}
+
+// meterEnd is the tick the i-th meter gives way to the next.
+func (m *TempoMap) meterEnd(i int) int64 {
+	if i+1 < len(m.Meters) {
+		return m.Meters[i+1].Tick
+	}
+	return math.MaxInt64
+}
+
+// BarBeat returns the 1-based bar and beat of a tick; the beat has a
+// fraction, so the second sixteenth of bar 3 in 4/4 is 3, 1.25. A meter
+// change that falls mid-bar starts a new bar.
+func (m *TempoMap) BarBeat(tick int64) (int, float64) {
+	bar := 1
+	for i, mt := range m.Meters {
+		perBar := m.ticksPerBar(mt)
+		end := m.meterEnd(i)
+		if tick < end {
+			rel := tick - mt.Tick
+			beatTicks := float64(m.TicksPerQuarter) * 4 / float64(mt.Denom)
+			return bar + int(rel/perBar), 1 + float64(rel%perBar)/beatTicks
+		}
+		bar += int((end - mt.Tick + perBar - 1) / perBar)
+	}
+	return bar, 1
+}
+
+// BarTick returns the tick bar (1-based) starts at.
+func (m *TempoMap) BarTick(bar int) int64 {
+	first := 1
+	for i, mt := range m.Meters {
+		perBar := m.ticksPerBar(mt)
+		end := m.meterEnd(i)
+		bars := int((end - mt.Tick + perBar - 1) / perBar)
+		if end == math.MaxInt64 || bar < first+bars {
+			return mt.Tick + int64(bar-first)*perBar
+		}
+		first += bars
+	}
+	return 0
+}
+
+// Edit describes timing changes applied to parsed notes.
+type Edit struct {
+	Grid       int     // quantize grid as a note value (16 = sixteenths); 0 leaves timing alone
+	Strength   float64 // how far notes move toward the grid, 0 to 1
+	Swing      float64 // delays every second grid line: 0 straight, 1 triplet feel
+	TempoScale float64 // playback speed, 1.1 is 10% faster; 0 means 1
+	FromBar    int     // first bar to keep (1-based); 0 keeps from the start
+	ToBar      int     // last bar to keep, inclusive; 0 keeps to the end
+}
+
+// quantize moves a tick toward the nearest (swung) grid line.
+func (m *TempoMap) quantize(tick int64, edit Edit) int64 {
+	grid := float64(m.TicksPerQuarter) * 4 / float64(edit.Grid)
+	pair := 2 * grid
+	base := math.Floor(float64(tick)/pair) * pair
+	nearest := base
+	for _, line := range []float64{base + grid*(1+edit.Swing/3), base + pair} {
+		if math.Abs(line-float64(tick)) < math.Abs(nearest-float64(tick)) {
+			nearest = line
+		}
+	}
+	return tick + int64(math.Round(edit.Strength*(nearest-float64(tick))))
+}
+
+// Apply quantizes, selects the bar range and rescales the tempo of events.
+// Durations are kept in ticks when quantizing; notes running past the end
+// of the range are cut at its end. Bar and Beat stay positions in the
+// original song, so bar 17 is still bar 17 after selecting bars 17-32.
+func (m *TempoMap) Apply(events []NoteEvent, edit Edit) []NoteEvent {
+	from, to := m.rangeTicks(edit)
+	rangeEnd := math.Inf(1)
+	if to != math.MaxInt64 {
+		rangeEnd = m.Seconds(to)
+	}
+
+	var out []NoteEvent
+	for _, e := range events {
+		if edit.Grid > 0 {
+			q := m.quantize(e.StartTick, edit)
+			e.StartTick, e.EndTick = q, e.EndTick+q-e.StartTick
+			e.Start = m.Seconds(e.StartTick)
+			e.Duration = m.Seconds(e.EndTick) - e.Start
+			e.Bar, e.Beat = m.BarBeat(e.StartTick)
+		}
+		if e.StartTick < from || e.StartTick >= to {
+			continue
+		}
+		e.Duration = math.Min(e.Duration, rangeEnd-e.Start)
+		e.Start = m.EditTime(e.Start, edit)
+		e.Duration /= tempoScale(edit)
+		out = append(out, e)
+	}
+	return out
+}
+
+// EditTime maps a time in the original song to the edited one, for markers
+// and lyrics that should follow the notes.
+func (m *TempoMap) EditTime(seconds float64, edit Edit) float64 {
+	from, _ := m.rangeTicks(edit)
+	return (seconds - m.Seconds(from)) / tempoScale(edit)
+}
+
+// EditMarkers maps marker times like EditTime and drops the markers that
+// fall outside the selected bars, as Apply does for notes.
+func (m *TempoMap) EditMarkers(markers []Marker, edit Edit) []Marker {
+	from, to := m.rangeTicks(edit)
+	start, end := m.Seconds(from), math.Inf(1)
+	if to != math.MaxInt64 {
+		end = m.Seconds(to)
+	}
+
+	var out []Marker
+	for _, mk := range markers {
+		if mk.Time < start || mk.Time >= end {
+			continue
+		}
+		mk.Time = m.EditTime(mk.Time, edit)
+		out = append(out, mk)
+	}
+	return out
+}
+
+func (m *TempoMap) rangeTicks(edit Edit) (int64, int64) {
+	from, to := int64(0), int64(math.MaxInt64)
+	if edit.FromBar > 0 {
+		from = m.BarTick(edit.FromBar)
+	}
+	if edit.ToBar > 0 {
+		to = m.BarTick(edit.ToBar + 1)
+	}
+	return from, to
+}
+
+func tempoScale(edit Edit) float64 {
+	if edit.TempoScale <= 0 {
+		return 1
+	}
+	return edit.TempoScale
+}
@@ -0,0 +1,146 @@
+package midiparse
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"gitlab.com/gomidi/midi/v2/smf"
+)
+
+// testTempoMap is a tempo map at the default 120 BPM and 960 ticks per
+// quarter, so a quarter is 0.5s.
+func testTempoMap(t *testing.T, meters ...Meter) *TempoMap {
+	t.Helper()
+	s := smf.New()
+	s.TimeFormat = smf.MetricTicks(960)
+	m, err := newTempoMap(s, meters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// noteAt is a one-beat note at a tick of testTempoMap.
+func noteAt(tick int64) NoteEvent {
+	return NoteEvent{Note: 60, StartTick: tick, EndTick: tick + 960, Start: float64(tick) / 1920, Duration: 0.5}
+}
+
+func TestBarBeatAndBarTick(t *testing.T) {
+	// 4/4 for two bars, 3/4 from bar 3, then 6/8 one beat into bar 4, which
+	// cuts bar 4 short
+	m := testTempoMap(t, Meter{Tick: 7680, Num: 3, Denom: 4}, Meter{Tick: 11520, Num: 6, Denom: 8})
+	tests := []struct {
+		tick int64
+		bar  int
+		beat float64
+	}{
+		{0, 1, 1},
+		{960, 1, 2},
+		{3840 + 480, 2, 1.5},
+		{7680, 3, 1},
+		{10560, 4, 1},
+		{11520, 5, 1},
+		{11520 + 1440, 5, 4},
+		{14400, 6, 1},
+	}
+	for _, tt := range tests {
+		bar, beat := m.BarBeat(tt.tick)
+		if bar != tt.bar || beat != tt.beat {
+			t.Errorf("BarBeat(%d) = %d, %g, want %d, %g", tt.tick, bar, beat, tt.bar, tt.beat)
+		}
+	}
+	for bar, want := range map[int]int64{1: 0, 2: 3840, 3: 7680, 4: 10560, 5: 11520, 6: 14400} {
+		if got := m.BarTick(bar); got != want {
+			t.Errorf("BarTick(%d) = %d, want %d", bar, got, want)
+		}
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	m := testTempoMap(t)
+	tests := []struct {
+		name string
+		tick int64
+		edit Edit
+		want int64
+	}{
+		{"to the nearest sixteenth", 250, Edit{Grid: 16, Strength: 1}, 240},
+		{"up to the next line", 130, Edit{Grid: 16, Strength: 1}, 240},
+		{"half strength", 300, Edit{Grid: 16, Strength: 0.5}, 270},
+		{"eighths", 300, Edit{Grid: 8, Strength: 1}, 480},
+		{"swing delays the off-beat", 300, Edit{Grid: 16, Strength: 1, Swing: 1}, 320},
+		{"swing leaves the on-beat", 100, Edit{Grid: 16, Strength: 1, Swing: 1}, 0},
+	}
+	for _, tt := range tests {
+		if got := m.quantize(tt.tick, tt.edit); got != tt.want {
+			t.Errorf("%s: quantize(%d) = %d, want %d", tt.name, tt.tick, got, tt.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	m := testTempoMap(t)
+	events := []NoteEvent{noteAt(960), noteAt(4800), noteAt(7200), noteAt(7680)}
+
+	type timing struct{ start, duration float64 }
+	tests := []struct {
+		name   string
+		events []NoteEvent
+		edit   Edit
+		want   []timing
+	}{
+		{
+			name:   "bar 2 only, the last note cut at its end",
+			events: events,
+			edit:   Edit{FromBar: 2, ToBar: 2},
+			want:   []timing{{0.5, 0.5}, {1.75, 0.25}},
+		},
+		{
+			name:   "twice as fast",
+			events: events,
+			edit:   Edit{FromBar: 2, ToBar: 2, TempoScale: 2},
+			want:   []timing{{0.25, 0.25}, {0.875, 0.125}},
+		},
+		{
+			name:   "from bar 2 to the end",
+			events: events,
+			edit:   Edit{FromBar: 2},
+			want:   []timing{{0.5, 0.5}, {1.75, 0.5}, {2, 0.5}},
+		},
+		{
+			name:   "quantized, keeping the length in ticks",
+			events: []NoteEvent{noteAt(250)},
+			edit:   Edit{Grid: 16, Strength: 1},
+			want:   []timing{{0.125, 0.5}},
+		},
+	}
+	for _, tt := range tests {
+		out := m.Apply(tt.events, tt.edit)
+		var got []timing
+		for _, e := range out {
+			got = append(got, timing{math.Round(e.Start*1e6) / 1e6, math.Round(e.Duration*1e6) / 1e6})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Apply = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Bar and beat stay positions in the original song
+	out := m.Apply([]NoteEvent{noteAt(4800)}, Edit{FromBar: 2, Grid: 4, Strength: 1})
+	if out[0].Bar != 2 || out[0].Beat != 2 {
+		t.Errorf("quantized note at bar %d beat %g, want bar 2 beat 2", out[0].Bar, out[0].Beat)
+	}
+}
+
+func TestEditMarkersDropsOutsideBars(t *testing.T) {
+	m := testTempoMap(t)
+
+	// 4/4 at the default 120 BPM: bar 2 is 2s to 4s
+	markers := []Marker{{Time: 1, Text: "intro"}, {Time: 2.5, Text: "verse"}, {Time: 4, Text: "chorus"}}
+	got := m.EditMarkers(markers, Edit{FromBar: 2, ToBar: 2})
+	want := []Marker{{Time: 0.5, Text: "verse"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EditMarkers = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,235 @@
+package midiparse
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// chordTolerance is how close note starts must be to count as one chord.
+const chordTolerance = 0.03 // seconds
+
+// DrumChannel is MIDI channel 10, the General MIDI percussion channel.
+const DrumChannel = 9
+
+// IsDrum reports whether the event is on the drum channel. Its keys are drum
+// sounds, not pitches, whether or not a drum kit plays them, so nothing that
+// works on pitch (transposition, harmony, arpeggios, note names) touches it.
+func (e NoteEvent) IsDrum() bool {
+	return e.Channel == DrumChannel
+}
+
+// splitDrums separates drum channel events from pitched ones.
+func splitDrums(events []NoteEvent) (pitched, drums []NoteEvent) {
+	for _, e := range events {
+		if e.IsDrum() {
+			drums = append(drums, e)
+		} else {
+			pitched = append(pitched, e)
+		}
+	}
+	return pitched, drums
+}
+
+// sortByStart sorts events by start, then pitch, so chords read bottom up.
+func sortByStart(events []NoteEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Start != events[j].Start {
+			return events[i].Start < events[j].Start
+		}
+		return events[i].Note < events[j].Note
+	})
+}
+
+// chords groups sorted events of each track into notes starting together.
+func chords(events []NoteEvent) [][]NoteEvent {
+	byTrack := map[int][]NoteEvent{}
+	var tracks []int
+	for _, e := range events {
+		if _, ok := byTrack[e.Track]; !ok {
+			tracks = append(tracks, e.Track)
+		}
+		byTrack[e.Track] = append(byTrack[e.Track], e)
+	}
+	sort.Ints(tracks)
+
+	var groups [][]NoteEvent
+	for _, t := range tracks {
+		var cur []NoteEvent
+		for _, e := range byTrack[t] {
+			if len(cur) > 0 && e.Start-cur[0].Start > chordTolerance {
+				groups = append(groups, cur)
+				cur = nil
+			}
+			cur = append(cur, e)
+		}
+		if len(cur) > 0 {
+			groups = append(groups, cur)
+		}
+	}
+	return groups
+}
+
+// Arpeggio describes how chords are broken up.
+type Arpeggio struct {
+	Pattern string  // up, down, updown or random
+	Step    float64 // seconds between arpeggio notes
+	Seed    int64   // for the random pattern
+}
+
+// Arpeggiate replaces every chord (notes of a track starting within 30ms of
+// each other) with its notes played one after another every Step seconds,
+// cycling through the pattern until the chord's longest note ends. Single
+// notes and drums are left alone.
+func Arpeggiate(events []NoteEvent, arp Arpeggio) ([]NoteEvent, error) {
+	if arp.Step <= 0 {
+		return nil, fmt.Errorf("arpeggio step must be positive")
+	}
+	switch arp.Pattern {
+	case "up", "down", "updown", "random":
+	default:
+		return nil, fmt.Errorf("unknown arpeggio pattern %q", arp.Pattern)
+	}
+	rng := rand.New(rand.NewSource(arp.Seed))
+
+	sorted, out := splitDrums(events)
+	sortByStart(sorted)
+
+	for _, chord := range chords(sorted) {
+		if len(chord) == 1 {
+			out = append(out, chord[0])
+			continue
+		}
+
+		start, end := chord[0].Start, 0.0
+		for _, e := range chord {
+			end = math.Max(end, e.Start+e.Duration)
+		}
+
+		// One cycle of the pattern over the chord, bottom to top
+		order := make([]int, len(chord))
+		for i := range order {
+			order[i] = i
+		}
+		switch arp.Pattern {
+		case "down":
+			for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+				order[i], order[j] = order[j], order[i]
+			}
+		case "updown":
+			for i := len(chord) - 2; i > 0; i-- {
+				order = append(order, i)
+			}
+		}
+
+		for step := 0; ; step++ {
+			t := start + float64(step)*arp.Step
+			if t >= end-0.001 {
+				break
+			}
+			idx := order[step%len(order)]
+			if arp.Pattern == "random" {
+				idx = rng.Intn(len(chord))
+			}
+			e := chord[idx]
+			e.Start = t
+			e.Duration = math.Min(arp.Step, end-t)
+			out = append(out, e)
+		}
+	}
+	sortByStart(out)
+	return out, nil
+}
+
+// Harmonize adds a diatonic harmony to every note: interval is the scale
+// degree distance (2 for a third, 5 for a sixth), negative for below. The
+// harmony copies the note's timing and track at 80% velocity. Drums are
+// not harmonized.
+func Harmonize(events []NoteEvent, key Key, interval int) []NoteEvent {
+	out := make([]NoteEvent, 0, 2*len(events))
+	for _, e := range events {
+		out = append(out, e)
+		if e.IsDrum() {
+			continue
+		}
+		degree, octave := key.Degree(e.Note)
+		h := e
+		h.Note = key.Note(degree+interval, octave) + (e.Note - key.Note(degree, octave))
+		if h.Note < 0 || h.Note > 127 {
+			continue
+		}
+		h.Velocity = int(math.Max(1, math.Round(float64(e.Velocity)*0.8)))
+		out = append(out, h)
+	}
+	sortByStart(out)
+	return out
+}
+
+// LimitPolyphony keeps at most max notes sounding at once. When a note
+// starts with every voice taken, a voice is stolen by rule (oldest, lowest
+// or quietest): the stolen note is cut at the new note's start, or dropped
+// if they start together. Drum hits do not take a voice and are kept as is.
+func LimitPolyphony(events []NoteEvent, max int, rule string) ([]NoteEvent, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("polyphony limit must be at least 1")
+	}
+	switch rule {
+	case "oldest", "lowest", "quietest":
+	default:
+		return nil, fmt.Errorf("unknown voice stealing rule %q", rule)
+	}
+
+	out, drums := splitDrums(events)
+	sortByStart(out)
+	dropped := make([]bool, len(out))
+
+	var active []int // indices into out
+	for i, e := range out {
+		// Release voices that have ended
+		kept := active[:0]
+		for _, a := range active {
+			if out[a].Start+out[a].Duration > e.Start+1e-9 {
+				kept = append(kept, a)
+			}
+		}
+		active = kept
+
+		if len(active) >= max {
+			victim := 0
+			for j, a := range active {
+				v := out[active[victim]]
+				switch rule {
+				case "oldest":
+					if out[a].Start < v.Start {
+						victim = j
+					}
+				case "lowest":
+					if out[a].Note < v.Note {
+						victim = j
+					}
+				case "quietest":
+					if out[a].Velocity < v.Velocity {
+						victim = j
+					}
+				}
+			}
+			stolen := active[victim]
+			out[stolen].Duration = e.Start - out[stolen].Start
+			if out[stolen].Duration <= 0 {
+				dropped[stolen] = true
+			}
+			active = append(active[:victim], active[victim+1:]...)
+		}
+		active = append(active, i)
+	}
+
+	limited := drums
+	for i, e := range out {
+		if !dropped[i] {
+			limited = append(limited, e)
+		}
+	}
+	sortByStart(limited)
+	return limited, nil
+}
@@ -0,0 +1,221 @@
+package midiparse
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// TestPassesSkipDrums runs the arrangement passes over a chord with a kick
+// and snare hit at the same time; the drum hits must come out unchanged.
+func TestPassesSkipDrums(t *testing.T) {
+	drums := []NoteEvent{
+		{Note: 36, Start: 0, Duration: 0.1, Channel: DrumChannel, Velocity: 100},
+		{Note: 38, Start: 0, Duration: 0.1, Channel: DrumChannel, Velocity: 40},
+	}
+	chord := []NoteEvent{
+		{Note: 60, Start: 0, Duration: 1, Velocity: 100},
+		{Note: 64, Start: 0, Duration: 1, Velocity: 100},
+	}
+	events := append(append([]NoteEvent(nil), drums...), chord...)
+
+	key, err := ParseKey("C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arpeggiated, err := Arpeggiate(events, Arpeggio{Pattern: "up", Step: 0.25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, err := LimitPolyphony(events, 1, "quietest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passes := map[string][]NoteEvent{
+		"Arpeggiate":     arpeggiated,
+		"Harmonize":      Harmonize(events, key, 2),
+		"LimitPolyphony": limited,
+	}
+	for name, out := range passes {
+		var got []NoteEvent
+		for _, e := range out {
+			if e.Channel == DrumChannel {
+				got = append(got, e)
+			}
+		}
+		if !reflect.DeepEqual(got, drums) {
+			t.Errorf("%s changed the drums: %+v", name, got)
+		}
+		if len(out) == len(drums) {
+			t.Errorf("%s dropped the pitched notes", name)
+		}
+	}
+}
+
+// pitches lists the notes and starts of events, for comparing pass output.
+func pitches(events []NoteEvent) [][2]float64 {
+	var out [][2]float64
+	for _, e := range events {
+		out = append(out, [2]float64{float64(e.Note), math.Round(e.Start*1000) / 1000})
+	}
+	return out
+}
+
+func TestArpeggiate(t *testing.T) {
+	chord := func(length float64, notes ...int) []NoteEvent {
+		var events []NoteEvent
+		for _, n := range notes {
+			events = append(events, NoteEvent{Note: n, Duration: length, Velocity: 100})
+		}
+		return events
+	}
+	tests := []struct {
+		name    string
+		events  []NoteEvent
+		pattern string
+		want    [][2]float64
+	}{
+		{"up", chord(1, 64, 60, 67), "up", [][2]float64{{60, 0}, {64, 0.25}, {67, 0.5}, {60, 0.75}}},
+		{"down", chord(1, 60, 64, 67), "down", [][2]float64{{67, 0}, {64, 0.25}, {60, 0.5}, {67, 0.75}}},
+		{"updown", chord(1.5, 60, 64, 67), "updown", [][2]float64{{60, 0}, {64, 0.25}, {67, 0.5}, {64, 0.75}, {60, 1}, {64, 1.25}}},
+		{"until the longest note ends", chord(0.6, 60, 64), "up", [][2]float64{{60, 0}, {64, 0.25}, {60, 0.5}}},
+		{"single note", chord(1, 60), "up", [][2]float64{{60, 0}}},
+		{
+			"within the chord tolerance",
+			[]NoteEvent{{Note: 60, Duration: 0.5}, {Note: 64, Start: 0.02, Duration: 0.5}},
+			"up",
+			[][2]float64{{60, 0}, {64, 0.25}, {60, 0.5}},
+		},
+		{
+			"tracks arpeggiate separately",
+			[]NoteEvent{{Note: 60, Duration: 0.5}, {Note: 64, Duration: 0.5, Track: 1}},
+			"up",
+			[][2]float64{{60, 0}, {64, 0}},
+		},
+	}
+	for _, tt := range tests {
+		out, err := Arpeggiate(tt.events, Arpeggio{Pattern: tt.pattern, Step: 0.25})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pitches(out); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Arpeggiate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	out, err := Arpeggiate(chord(0.6, 60, 64), Arpeggio{Pattern: "up", Step: 0.25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := out[len(out)-1].Duration; math.Abs(d-0.1) > 1e-9 {
+		t.Errorf("last arpeggio note lasts %g, want 0.1", d)
+	}
+
+	a, _ := Arpeggiate(chord(2, 60, 64, 67), Arpeggio{Pattern: "random", Step: 0.25, Seed: 7})
+	b, _ := Arpeggiate(chord(2, 60, 64, 67), Arpeggio{Pattern: "random", Step: 0.25, Seed: 7})
+	if !reflect.DeepEqual(a, b) || len(a) != 8 {
+		t.Errorf("random pattern is not repeatable for a seed: %v, %v", pitches(a), pitches(b))
+	}
+
+	for _, arp := range []Arpeggio{{Pattern: "up"}, {Pattern: "sideways", Step: 0.25}} {
+		if _, err := Arpeggiate(chord(1, 60, 64), arp); err == nil {
+			t.Errorf("Arpeggiate(%+v) did not fail", arp)
+		}
+	}
+}
+
+func TestHarmonize(t *testing.T) {
+	tests := []struct {
+		key            string
+		note, interval int
+		want           int
+	}{
+		{"C", 64, 2, 67},  // E + third = G
+		{"C", 71, 2, 74},  // B + third = D above
+		{"C", 60, 5, 69},  // sixth
+		{"C", 60, -2, 57}, // third below
+		{"C", 66, 2, 70},  // F# keeps its sharp over the A
+		{"Am", 69, 2, 72}, // A + third = C in A minor
+		{"G", 66, 2, 69},  // F# is in G
+		{"C", 127, 2, -1}, // out of range: no harmony
+	}
+	for _, tt := range tests {
+		key, err := ParseKey(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := Harmonize([]NoteEvent{{Note: tt.note, Start: 1, Duration: 0.5, Velocity: 100}}, key, tt.interval)
+		if tt.want < 0 {
+			if len(out) != 1 {
+				t.Errorf("%s: %d %+d added %v, want no harmony", tt.key, tt.note, tt.interval, pitches(out))
+			}
+			continue
+		}
+		var h *NoteEvent
+		for i := range out {
+			if out[i].Note != tt.note {
+				h = &out[i]
+			}
+		}
+		if len(out) != 2 || h == nil || h.Note != tt.want || h.Start != 1 || h.Duration != 0.5 || h.Velocity != 80 {
+			t.Errorf("%s: %d %+d = %+v, want note %d at the same time, velocity 80", tt.key, tt.note, tt.interval, out, tt.want)
+		}
+	}
+}
+
+func TestLimitPolyphony(t *testing.T) {
+	// Three voices sound when D arrives at 1s: A is oldest, B lowest, C quietest
+	events := []NoteEvent{
+		{Note: 60, Start: 0, Duration: 2, Velocity: 100},
+		{Note: 55, Start: 0.25, Duration: 2, Velocity: 90},
+		{Note: 67, Start: 0.5, Duration: 2, Velocity: 30},
+		{Note: 72, Start: 1, Duration: 2, Velocity: 100},
+	}
+	tests := []struct {
+		rule   string
+		stolen int // note cut at 1s
+	}{
+		{"oldest", 60},
+		{"lowest", 55},
+		{"quietest", 67},
+	}
+	for _, tt := range tests {
+		out, err := LimitPolyphony(events, 3, tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != len(events) {
+			t.Fatalf("%s: %d notes left, want %d", tt.rule, len(out), len(events))
+		}
+		for _, e := range out {
+			want := 2.0
+			if e.Note == tt.stolen {
+				want = 1 - e.Start
+			}
+			if math.Abs(e.Duration-want) > 1e-9 {
+				t.Errorf("%s: note %d lasts %g, want %g", tt.rule, e.Note, e.Duration, want)
+			}
+		}
+	}
+
+	// A voice stolen by a note starting with it is dropped; ended notes free
+	// their voice
+	out, err := LimitPolyphony([]NoteEvent{
+		{Note: 60, Duration: 1, Velocity: 100},
+		{Note: 64, Duration: 1, Velocity: 100},
+		{Note: 67, Start: 1, Duration: 1, Velocity: 100},
+	}, 1, "oldest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pitches(out), [][2]float64{{64, 0}, {67, 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LimitPolyphony = %v, want %v", got, want)
+	}
+
+	if _, err := LimitPolyphony(events, 0, "oldest"); err == nil {
+		t.Errorf("a limit of 0 voices did not fail")
+	}
+	if _, err := LimitPolyphony(events, 2, "loudest"); err == nil {
+		t.Errorf("an unknown rule did not fail")
+	}
+}
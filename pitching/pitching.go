@@ -1,13 +1,17 @@
 package pitching
 
 import (
+	"context"
 	"fmt"
+	"hello/cmdrun"
 	"math"
-	"os/exec"
 	"strconv"
 	"strings"
 )
 
+// Runner executes aubiopitch, sox and cp. Swap it for a *cmdrun.Recorder in tests.
+var Runner cmdrun.Runner = cmdrun.Default
+
 // pitchCorrectAudio detects the pitch of the input audio and shifts it to the nearest MIDI note
 func PitchCorrectAudio(inputAudio, outputAudio string, targetMIDI float64) error {
 	// Step 1: Detect the current pitch using aubiopitch
@@ -38,16 +42,16 @@ func PitchCorrectAudio(inputAudio, outputAudio string, targetMIDI float64) error
 	if math.Abs(centsShift) < 1 {
 		fmt.Println("Pitch is already close to target, no correction needed")
 		// Just copy the file
-		return exec.Command("cp", inputAudio, outputAudio).Run()
+		_, err := cmdrun.Silenced(Runner).Run(context.Background(), "cp", inputAudio, outputAudio)
+		return err
 	}
 
-	cmd := exec.Command(
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(),
 		"sox", inputAudio, outputAudio,
 		"pitch", fmt.Sprintf("%.2f", centsShift),
 	)
-	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("sox pitch shift failed: %w, output: %s", err, string(output))
+		return fmt.Errorf("sox pitch shift failed: %w, output: %s", err, string(res.Combined()))
 	}
 
 	fmt.Printf("Successfully pitch corrected by %.2f cents\n", centsShift)
@@ -56,8 +60,8 @@ func PitchCorrectAudio(inputAudio, outputAudio string, targetMIDI float64) error
 
 // detectPitch uses aubiopitch to detect the dominant frequency in the audio file
 func detectPitch(audioPath string) (float64, error) {
-	cmd := exec.Command("aubiopitch", "-i", audioPath)
-	output, err := cmd.CombinedOutput()
+	res, err := cmdrun.Silenced(Runner).Run(context.Background(), "aubiopitch", "-i", audioPath)
+	output := res.Combined()
 	if err != nil {
 		return 0, fmt.Errorf("aubiopitch failed: %w", err)
 	}
@@ -0,0 +1,143 @@
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Profile describes the output format shared by clip extraction, every batch
+// render and the final concat, so segments can be joined with -c copy.
+type Profile struct {
+	Name         string `json:"name"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	FPS          int    `json:"fps"`
+	VideoCodec   string `json:"video_codec"`
+	CRF          int    `json:"crf"`           // used when VideoBitrate is empty; 0 is lossless, NoCRF the encoder default
+	VideoBitrate string `json:"video_bitrate"` // e.g. "8M"; overrides CRF
+	Preset       string `json:"preset"`
+	AudioCodec   string `json:"audio_codec"`
+	AudioBitrate string `json:"audio_bitrate"`
+	SampleRate   int    `json:"sample_rate"`
+}
+
+// NoCRF leaves the quality to the encoder's default.
+const NoCRF = -1
+
+// Presets are the built-in profiles selectable with -profile.
+var Presets = map[string]Profile{
+	"1080p30": {
+		Name: "1080p30", Width: 1920, Height: 1080, FPS: 30,
+		VideoCodec: "libx264", CRF: 20, Preset: "medium",
+		AudioCodec: "aac", AudioBitrate: "192k", SampleRate: 44100,
+	},
+	"vertical": {
+		Name: "vertical", Width: 1080, Height: 1920, FPS: 30,
+		VideoCodec: "libx264", CRF: 20, Preset: "medium",
+		AudioCodec: "aac", AudioBitrate: "192k", SampleRate: 44100,
+	},
+	"square": {
+		Name: "square", Width: 1080, Height: 1080, FPS: 30,
+		VideoCodec: "libx264", CRF: 20, Preset: "medium",
+		AudioCodec: "aac", AudioBitrate: "192k", SampleRate: 44100,
+	},
+	"4k": {
+		Name: "4k", Width: 3840, Height: 2160, FPS: 30,
+		VideoCodec: "libx264", CRF: 18, Preset: "slow",
+		AudioCodec: "aac", AudioBitrate: "320k", SampleRate: 48000,
+	},
+	"preview": {
+		Name: "preview", Width: 854, Height: 480, FPS: 24,
+		VideoCodec: "libx264", CRF: 28, Preset: "veryfast",
+		AudioCodec: "aac", AudioBitrate: "128k", SampleRate: 44100,
+	},
+}
+
+// Default returns the 1080p30 profile.
+func Default() Profile {
+	return Presets["1080p30"]
+}
+
+// Get returns a built-in profile by name.
+func Get(name string) (Profile, error) {
+	p, ok := Presets[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile %q (available: %v)", name, Names())
+	}
+	return p, nil
+}
+
+// Names returns the built-in profile names, sorted.
+func Names() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load reads a JSON config file. Fields it sets override base, so a config
+// can be as small as {"fps": 60}.
+func Load(path string, base Profile) (Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to read profile config: %w", err)
+	}
+	p := base
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Profile{}, fmt.Errorf("failed to parse profile config %s: %w", path, err)
+	}
+	return p, p.Validate()
+}
+
+// Validate reports settings ffmpeg would reject or that break concat.
+func (p Profile) Validate() error {
+	if p.Width <= 0 || p.Height <= 0 || p.Width%2 != 0 || p.Height%2 != 0 {
+		return fmt.Errorf("profile %s: resolution %dx%d must be positive and even", p.Name, p.Width, p.Height)
+	}
+	if p.FPS <= 0 {
+		return fmt.Errorf("profile %s: fps must be positive", p.Name)
+	}
+	if p.SampleRate <= 0 {
+		return fmt.Errorf("profile %s: sample rate must be positive", p.Name)
+	}
+	if p.CRF < NoCRF {
+		return fmt.Errorf("profile %s: crf must be 0 or more, or %d for the encoder default", p.Name, NoCRF)
+	}
+	if p.VideoCodec == "" || p.AudioCodec == "" {
+		return fmt.Errorf("profile %s: video and audio codecs are required", p.Name)
+	}
+	return nil
+}
+
+// Size returns the resolution as WxH, as used by -s and color=s=.
+func (p Profile) Size() string {
+	return fmt.Sprintf("%dx%d", p.Width, p.Height)
+}
+
+// VideoArgs returns the encoder arguments for the video stream.
+func (p Profile) VideoArgs() []string {
+	args := []string{"-c:v", p.VideoCodec}
+	if p.Preset != "" {
+		args = append(args, "-preset", p.Preset)
+	}
+	if p.VideoBitrate != "" {
+		args = append(args, "-b:v", p.VideoBitrate)
+	} else if p.CRF != NoCRF {
+		args = append(args, "-crf", strconv.Itoa(p.CRF))
+	}
+	return append(args, "-r", strconv.Itoa(p.FPS), "-pix_fmt", "yuv420p")
+}
+
+// AudioArgs returns the encoder arguments for the audio stream.
+func (p Profile) AudioArgs() []string {
+	args := []string{"-c:a", p.AudioCodec}
+	if p.AudioBitrate != "" {
+		args = append(args, "-b:a", p.AudioBitrate)
+	}
+	return append(args, "-ar", strconv.Itoa(p.SampleRate))
+}
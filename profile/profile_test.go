@@ -0,0 +1,45 @@
+package profile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVideoArgsCRF(t *testing.T) {
+	tests := []struct {
+		crf     int
+		bitrate string
+		want    string
+	}{
+		{20, "", "-c:v libx264 -preset medium -crf 20 -r 30 -pix_fmt yuv420p"},
+		{0, "", "-c:v libx264 -preset medium -crf 0 -r 30 -pix_fmt yuv420p"},
+		{NoCRF, "", "-c:v libx264 -preset medium -r 30 -pix_fmt yuv420p"},
+		{0, "8M", "-c:v libx264 -preset medium -b:v 8M -r 30 -pix_fmt yuv420p"},
+	}
+	for _, tt := range tests {
+		p := Default()
+		p.CRF, p.VideoBitrate = tt.crf, tt.bitrate
+		if got := strings.Join(p.VideoArgs(), " "); got != tt.want {
+			t.Errorf("crf %d, bitrate %q: got %q, want %q", tt.crf, tt.bitrate, got, tt.want)
+		}
+	}
+}
+
+func TestLoadLosslessCRF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lossless.json")
+	if err := os.WriteFile(path, []byte(`{"crf": 0}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(path, Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CRF != 0 {
+		t.Errorf("CRF = %d, want 0", p.CRF)
+	}
+	if Default().CRF != 20 {
+		t.Errorf("loading a config changed the preset")
+	}
+}